@@ -0,0 +1,1129 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil"
+	"github.com/decred/dcrlnd/lnrpc"
+	"github.com/decred/dcrlnd/lnrpc/invoicesrpc"
+	"github.com/golang/crypto/bcrypt"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// adminPath is the path of the admin dashboard, under which all the
+	// admin pages live.
+	adminPath = "/admin"
+
+	// adminLoginPath is the path of the login page of the admin dashboard.
+	adminLoginPath = adminPath + "/login"
+
+	// adminSessionCookie is the name of the cookie holding the ID of the
+	// admin session.
+	adminSessionCookie = "dcrtippin_admin"
+
+	// adminLoginCookie is the name of the cookie holding the CSRF token
+	// of the login form.
+	adminLoginCookie = "dcrtippin_admin_login"
+
+	// adminLoginTimeout is how long the login form may be submitted after
+	// it was rendered.
+	adminLoginTimeout = 10 * time.Minute
+
+	// adminLoginBurst and adminLoginInterval limit the rate at which each
+	// client may attempt to log in, independently of the rate limit of
+	// the invoices the operator may change.
+	adminLoginBurst    = 5
+	adminLoginInterval = time.Minute
+
+	// adminMaxSessions is the largest number of concurrent admin
+	// sessions. Once reached, logging in ends the session closest to
+	// expiring.
+	adminMaxSessions = 16
+
+	// adminNumRecentTips is the number of most recent tips listed on the
+	// admin dashboard.
+	adminNumRecentTips = 50
+
+	// adminNumRecentDeliveries is the number of most recent webhook
+	// deliveries listed on the admin dashboard.
+	adminNumRecentDeliveries = 50
+
+	// adminNumRecentClosures is the number of most recently closed
+	// channels listed on the admin dashboard.
+	adminNumRecentClosures = 50
+
+	// adminTimeLayout is the layout of the times on the admin dashboard.
+	adminTimeLayout = "2006-01-02 15:04:05 MST"
+
+	// totpPeriod and totpDigits are the parameters of the one-time
+	// passwords, the ones used by the common authenticator apps. The
+	// number of digits is also hardcoded in totpCode.
+	totpPeriod = 30
+	totpDigits = 6
+
+	// totpSkew is the number of periods before and after the current one
+	// whose passwords are accepted, to allow for clock drift.
+	totpSkew = 1
+
+	// minTOTPSecretSize is the smallest secret of the one-time passwords
+	// accepted, as recommended by RFC 4226.
+	minTOTPSecretSize = 16
+)
+
+// parseTOTPSecret decodes the base32 encoded secret of the one-time
+// passwords, as displayed by authenticator apps.
+func parseTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Replace(s, " ", "", -1))
+	s = strings.TrimRight(s, "=")
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).
+		DecodeString(s)
+	if err != nil {
+		return nil, errors.New("must be base32 encoded")
+	}
+	if len(secret) < minTOTPSecretSize {
+		return nil, fmt.Errorf("must be at least %d bytes long",
+			minTOTPSecretSize)
+	}
+
+	return secret, nil
+}
+
+// totpCode returns the one-time password of the given period as described
+// by RFC 6238.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// checkTOTP returns the period of the one-time password if it's valid at the
+// given time.
+func checkTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	step := now.Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if tokensEqual(totpCode(secret, s), code) {
+			return s, true
+		}
+	}
+
+	return 0, false
+}
+
+// hashPassword reads the password of the admin dashboard from the first
+// line of r and returns its bcrypt hash.
+func hashPassword(r io.Reader) ([]byte, error) {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return nil, errors.New("empty password")
+	}
+
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// randomToken returns a random hex encoded token used to identify sessions
+// and protect forms.
+func randomToken() (string, error) {
+	var token [32]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token[:]), nil
+}
+
+// tokensEqual compares two tokens in constant time.
+func tokensEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// adminSession is a logged in session of the operator on the admin
+// dashboard.
+type adminSession struct {
+	id string
+
+	// csrfToken must be submitted along with every form of the session.
+	csrfToken string
+
+	// expiresAt is when the session ends unless it's used again.
+	expiresAt time.Time
+}
+
+// adminAuth authenticates the operator on the admin dashboard, either with a
+// password, a one-time password or both, and keeps track of their sessions.
+// Sessions are kept in memory, so restarting the faucet logs the operator
+// out.
+type adminAuth struct {
+	// passwordHash is the bcrypt hash of the password, empty if no
+	// password is required.
+	passwordHash []byte
+
+	// totpSecret is the secret of the one-time passwords, empty if none
+	// are required.
+	totpSecret []byte
+
+	// sessionTimeout is how long a session stays valid without activity.
+	sessionTimeout time.Duration
+
+	// secureCookies indicates the cookies must only be sent over HTTPS.
+	secureCookies bool
+
+	mtx      sync.Mutex
+	sessions map[string]*adminSession
+
+	// lastTOTPStep is the period of the last one-time password accepted,
+	// so none can be used twice.
+	lastTOTPStep int64
+}
+
+// newAdminAuth creates the authentication of the admin dashboard.
+func newAdminAuth(passwordHash string, totpSecret []byte,
+	sessionTimeout time.Duration, secureCookies bool) *adminAuth {
+
+	return &adminAuth{
+		passwordHash:   []byte(passwordHash),
+		totpSecret:     totpSecret,
+		sessionTimeout: sessionTimeout,
+		secureCookies:  secureCookies,
+		sessions:       make(map[string]*adminSession),
+	}
+}
+
+// checkCredentials reports whether the password and one-time password given
+// at the given time allow logging in.
+func (a *adminAuth) checkCredentials(password, otp string, now time.Time) bool {
+	if len(a.passwordHash) > 0 {
+		err := bcrypt.CompareHashAndPassword(
+			a.passwordHash, []byte(password),
+		)
+		if err != nil {
+			return false
+		}
+	}
+
+	if len(a.totpSecret) > 0 {
+		step, ok := checkTOTP(a.totpSecret, otp, now)
+		if !ok {
+			return false
+		}
+
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+
+		// A one-time password observed by someone else must not let
+		// them in.
+		if step <= a.lastTOTPStep {
+			return false
+		}
+		a.lastTOTPStep = step
+	}
+
+	return true
+}
+
+// newSession starts a session at the given time.
+func (a *adminAuth) newSession(now time.Time) (*adminSession, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	session := &adminSession{
+		id:        id,
+		csrfToken: csrfToken,
+		expiresAt: now.Add(a.sessionTimeout),
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if len(a.sessions) >= adminMaxSessions {
+		var oldest *adminSession
+		for id, s := range a.sessions {
+			if !now.Before(s.expiresAt) {
+				delete(a.sessions, id)
+				continue
+			}
+			if oldest == nil || s.expiresAt.Before(oldest.expiresAt) {
+				oldest = s
+			}
+		}
+		if len(a.sessions) >= adminMaxSessions {
+			delete(a.sessions, oldest.id)
+		}
+	}
+	a.sessions[session.id] = session
+
+	return session, nil
+}
+
+// session returns the session with the given ID if it's still valid at the
+// given time, extending it.
+func (a *adminAuth) session(id string, now time.Time) *adminSession {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	session, ok := a.sessions[id]
+	if !ok {
+		return nil
+	}
+	if !now.Before(session.expiresAt) {
+		delete(a.sessions, id)
+		return nil
+	}
+	session.expiresAt = now.Add(a.sessionTimeout)
+
+	return session
+}
+
+// endSession ends the session with the given ID.
+func (a *adminAuth) endSession(id string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	delete(a.sessions, id)
+}
+
+// cookie returns a cookie of the admin dashboard. The cookies are out of
+// reach of scripts and never sent along with requests from other sites.
+func (a *adminAuth) cookie(name, value, path string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// adminHeaders sets the headers of the admin pages, which must neither be
+// cached nor framed by other sites.
+func adminHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+}
+
+// requireAdmin returns the session of the operator issuing the request. If
+// they aren't logged in, they are redirected to the login page. Forms
+// submitted within the session must carry its CSRF token.
+func (l *lightningFaucet) requireAdmin(w http.ResponseWriter,
+	r *http.Request) (*adminSession, bool) {
+
+	adminHeaders(w)
+	if l.admin == nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	var session *adminSession
+	if cookie, err := r.Cookie(adminSessionCookie); err == nil {
+		session = l.admin.session(cookie.Value, time.Now())
+	}
+	if session == nil {
+		if r.Method == http.MethodGet {
+			http.Redirect(w, r, adminLoginPath, http.StatusSeeOther)
+		} else {
+			http.Error(w, "not logged in", http.StatusForbidden)
+		}
+		return nil, false
+	}
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "unable to parse form",
+				http.StatusBadRequest)
+			return nil, false
+		}
+		if !tokensEqual(r.PostFormValue("csrf_token"), session.csrfToken) {
+			log.Warnf("Invalid CSRF token on %s from %s", r.URL.Path,
+				l.limiter.clientIP(r))
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return nil, false
+		}
+	}
+
+	return session, true
+}
+
+// adminLoginPageContext is the context used to render the login page of the
+// admin dashboard.
+type adminLoginPageContext struct {
+	*homePageContext
+
+	// CSRFToken must be submitted along with the login form.
+	CSRFToken string
+
+	// PasswordRequired and OTPRequired indicate which credentials are
+	// required to log in.
+	PasswordRequired bool
+	OTPRequired      bool
+}
+
+// adminLogin renders the login page of the admin dashboard, starting a
+// session when valid credentials are submitted.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) adminLogin(w http.ResponseWriter, r *http.Request) {
+	adminHeaders(w)
+	if l.admin == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	pageState := &adminLoginPageContext{
+		homePageContext:  l.newHomePageContext(),
+		PasswordRequired: len(l.admin.passwordHash) > 0,
+		OTPRequired:      len(l.admin.totpSecret) > 0,
+	}
+	loginTemplate := l.templates.Lookup("admin_login.html")
+	render := func() {
+		err := loginTemplate.Execute(w, pageState)
+		if err != nil {
+			log.Errorf("unable to render admin login page: %v", err)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		token, err := randomToken()
+		if err != nil {
+			log.Errorf("Unable to generate CSRF token: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, l.admin.cookie(
+			adminLoginCookie, token, adminLoginPath,
+			int(adminLoginTimeout.Seconds()),
+		))
+		pageState.CSRFToken = token
+		render()
+		return
+
+	case http.MethodPost:
+
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	// There's no session yet, so the login form is protected by a token
+	// which must match the cookie set along with the form.
+	cookie, err := r.Cookie(adminLoginCookie)
+	if err != nil || !tokensEqual(r.PostFormValue("csrf_token"), cookie.Value) {
+		http.Error(w, "invalid CSRF token, reload the login page",
+			http.StatusForbidden)
+		return
+	}
+	pageState.CSRFToken = cookie.Value
+
+	allowed, wait := l.loginLimiter.allow(r)
+	if !allowed {
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		pageState.SubmissionError = TooManyAttempts
+		w.WriteHeader(apiStatusCode(TooManyAttempts))
+		render()
+		return
+	}
+
+	clientIP := l.loginLimiter.clientIP(r)
+	ok := l.admin.checkCredentials(
+		r.PostFormValue("password"), r.PostFormValue("otp"), time.Now(),
+	)
+	if !ok {
+		log.Warnf("Failed admin login from %s", clientIP)
+		pageState.SubmissionError = InvalidCredentials
+		w.WriteHeader(apiStatusCode(InvalidCredentials))
+		render()
+		return
+	}
+
+	session, err := l.admin.newSession(time.Now())
+	if err != nil {
+		log.Errorf("Unable to start admin session: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Admin logged in from %s", clientIP)
+
+	http.SetCookie(w, l.admin.cookie(adminLoginCookie, "", adminLoginPath, -1))
+	http.SetCookie(w, l.admin.cookie(adminSessionCookie, session.id, adminPath, 0))
+	http.Redirect(w, r, adminPath, http.StatusSeeOther)
+}
+
+// adminLogout ends the session of the operator.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) adminLogout(w http.ResponseWriter, r *http.Request) {
+	session, ok := l.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	l.admin.endSession(session.id)
+	http.SetCookie(w, l.admin.cookie(adminSessionCookie, "", adminPath, -1))
+	http.Redirect(w, r, adminLoginPath, http.StatusSeeOther)
+}
+
+// adminTip is a tip as listed on the admin dashboard.
+type adminTip struct {
+	RHash      string
+	CreatedAt  string
+	Amount     string
+	AmtPaid    string
+	Memo       string
+	Nickname   string
+	Recipient  string
+	RemoteAddr string
+	Status     invoiceStatus
+	Hidden     bool
+}
+
+// adminDelivery is a webhook delivery as listed on the admin dashboard.
+type adminDelivery struct {
+	ID          uint64
+	Endpoint    string
+	RHash       string
+	State       webhookDeliveryState
+	Attempts    int
+	LastStatus  int
+	LastError   string
+	CreatedAt   string
+	NextAttempt string
+}
+
+// adminWithdrawal is a pending withdrawal as listed on the admin dashboard.
+type adminWithdrawal struct {
+	PaymentHash string
+	Recipient   string
+	Amount      string
+	FeeLimit    string
+	Error       string
+	CreatedAt   string
+}
+
+// adminClosure is a channel closed by the reaper as listed on the admin
+// dashboard.
+type adminClosure struct {
+	ChannelPoint string
+	RemotePubkey string
+	Capacity     string
+	AgeBlocks    uint32
+	Reason       closeReason
+	Force        bool
+	ClosingTxid  string
+	ClosedAt     string
+}
+
+// adminSettings are the settings which can be changed through the admin
+// dashboard, as displayed in its form.
+type adminSettings struct {
+	MinAmount         string
+	MaxAmount         string
+	RateLimitBurst    string
+	RateLimitInterval string
+}
+
+// adminPageContext is the context used to render the admin dashboard.
+type adminPageContext struct {
+	*homePageContext
+
+	// CSRFToken must be submitted along with every form.
+	CSRFToken string
+
+	// Node is the state of the node, nil if it couldn't be queried.
+	Node *nodeInfo
+
+	// ChannelBalance and PendingOpenBalance are the balances of the
+	// channels in DCR, empty if they couldn't be queried.
+	ChannelBalance     string
+	PendingOpenBalance string
+
+	// WalletConfirmed and WalletUnconfirmed are the balances of the
+	// on-chain wallet in DCR, empty if they couldn't be queried.
+	WalletConfirmed   string
+	WalletUnconfirmed string
+
+	// MaxReceivable is the largest payment in DCR the node can receive,
+	// empty if unknown, and InboundLow whether it's below the alert
+	// threshold.
+	MaxReceivable string
+	InboundLow    bool
+
+	// Tips are the most recent tips, newest first.
+	Tips []*adminTip
+
+	// Deliveries are the most recent webhook deliveries, newest first.
+	Deliveries []*adminDelivery
+
+	// Closures are the most recently closed channels, newest first.
+	Closures []*adminClosure
+
+	// Withdrawals are the withdrawals whose outcome isn't known yet,
+	// oldest first.
+	Withdrawals []*adminWithdrawal
+
+	// Settings are the runtime settings displayed in the form.
+	Settings *adminSettings
+}
+
+// currentSettings returns the runtime settings in effect.
+func (l *lightningFaucet) currentSettings() *adminSettings {
+	minAmount, maxAmount := l.amountLimits()
+	burst, interval := l.limiter.rate()
+
+	return &adminSettings{
+		MinAmount:         formatAmount(minAmount),
+		MaxAmount:         formatAmount(maxAmount),
+		RateLimitBurst:    strconv.Itoa(burst),
+		RateLimitInterval: interval.String(),
+	}
+}
+
+// recentTips returns the n most recently requested tips, newest first.
+func (l *lightningFaucet) recentTips(now time.Time, n int) ([]*adminTip, error) {
+	var tips []*tipRecord
+	err := l.store.forEachTip(func(tip *tipRecord) error {
+		tips = append(tips, tip)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tips, func(i, j int) bool {
+		return tips[i].CreatedAt.After(tips[j].CreatedAt)
+	})
+	if len(tips) > n {
+		tips = tips[:n]
+	}
+
+	recent := make([]*adminTip, 0, len(tips))
+	for _, tip := range tips {
+		amount := formatAmount(dcrutil.Amount(tip.AmountAtoms))
+		if tip.openAmount() {
+			amount = "any"
+		}
+
+		recent = append(recent, &adminTip{
+			RHash:      hex.EncodeToString(tip.RHash),
+			CreatedAt:  tip.CreatedAt.UTC().Format(adminTimeLayout),
+			Amount:     amount,
+			AmtPaid:    formatAmount(dcrutil.Amount(tip.AmtPaidAtoms)),
+			Memo:       tip.Memo,
+			Nickname:   tip.Nickname,
+			Recipient:  tip.Recipient,
+			RemoteAddr: tip.RemoteAddr,
+			Status:     tip.status(now),
+			Hidden:     tip.Hidden,
+		})
+	}
+
+	return recent, nil
+}
+
+// recentDeliveries returns the n most recent webhook deliveries, newest
+// first.
+func (l *lightningFaucet) recentDeliveries(n int) ([]*adminDelivery, error) {
+	deliveries, err := l.store.recentDeliveries(n)
+	if err != nil {
+		return nil, err
+	}
+
+	recent := make([]*adminDelivery, 0, len(deliveries))
+	for _, d := range deliveries {
+		delivery := &adminDelivery{
+			ID:         d.ID,
+			Endpoint:   d.Endpoint,
+			RHash:      hex.EncodeToString(d.RHash),
+			State:      d.State,
+			Attempts:   d.Attempts,
+			LastStatus: d.LastStatus,
+			LastError:  d.LastError,
+			CreatedAt:  d.CreatedAt.UTC().Format(adminTimeLayout),
+		}
+		if d.State == webhookDeliveryPending {
+			delivery.NextAttempt = d.NextAttempt.UTC().Format(
+				adminTimeLayout,
+			)
+		}
+		recent = append(recent, delivery)
+	}
+
+	return recent, nil
+}
+
+// pendingWithdrawals returns the withdrawals whose outcome isn't known yet,
+// oldest first.
+func (l *lightningFaucet) pendingWithdrawals() ([]*adminWithdrawal, error) {
+	withdrawals, err := l.store.pendingWithdrawals()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]*adminWithdrawal, 0, len(withdrawals))
+	for _, w := range withdrawals {
+		pending = append(pending, &adminWithdrawal{
+			PaymentHash: hex.EncodeToString(w.PaymentHash),
+			Recipient:   w.Recipient,
+			Amount:      formatAmount(dcrutil.Amount(w.AmountAtoms)),
+			FeeLimit:    formatAmount(dcrutil.Amount(w.FeeLimitAtoms)),
+			Error:       w.Error,
+			CreatedAt:   w.CreatedAt.UTC().Format(adminTimeLayout),
+		})
+	}
+
+	return pending, nil
+}
+
+// recentClosures returns the n most recently closed channels, newest first.
+func (l *lightningFaucet) recentClosures(n int) ([]*adminClosure, error) {
+	closures, err := l.store.recentClosures(n)
+	if err != nil {
+		return nil, err
+	}
+
+	recent := make([]*adminClosure, 0, len(closures))
+	for _, c := range closures {
+		recent = append(recent, &adminClosure{
+			ChannelPoint: c.ChannelPoint,
+			RemotePubkey: c.RemotePubkey,
+			Capacity:     formatAmount(dcrutil.Amount(c.Capacity)),
+			AgeBlocks:    c.AgeBlocks,
+			Reason:       c.Reason,
+			Force:        c.Force,
+			ClosingTxid:  c.ClosingTxid,
+			ClosedAt:     c.ClosedAt.UTC().Format(adminTimeLayout),
+		})
+	}
+
+	return recent, nil
+}
+
+// renderAdmin renders the admin dashboard with the given status code. The
+// settings form displays settings, or the settings in effect if nil.
+func (l *lightningFaucet) renderAdmin(w http.ResponseWriter,
+	session *adminSession, settings *adminSettings,
+	submissionErr chanCreationError, status int) {
+
+	pageState := &adminPageContext{
+		homePageContext: l.newHomePageContext(),
+		CSRFToken:       session.csrfToken,
+		Settings:        settings,
+	}
+	pageState.SubmissionError = submissionErr
+	if pageState.Settings == nil {
+		pageState.Settings = l.currentSettings()
+	}
+
+	// The state of the node is queried on every request rather than
+	// taken from the node info monitor, so the operator sees it as of
+	// now. Balances require read permissions the invoice macaroon
+	// doesn't have, in which case they're displayed as unavailable.
+	info, err := l.lnd.GetInfo(l.ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		log.Warnf("Unable to get node info: %v", err)
+	} else {
+		pageState.Node = newNodeInfo(info)
+	}
+
+	chanBalance, err := l.lnd.ChannelBalance(
+		l.ctx, &lnrpc.ChannelBalanceRequest{},
+	)
+	if err != nil {
+		log.Debugf("Unable to get channel balance: %v", err)
+	} else {
+		pageState.ChannelBalance = formatAmount(
+			dcrutil.Amount(chanBalance.Balance),
+		)
+		pageState.PendingOpenBalance = formatAmount(
+			dcrutil.Amount(chanBalance.PendingOpenBalance),
+		)
+	}
+
+	walletBalance, err := l.lnd.WalletBalance(
+		l.ctx, &lnrpc.WalletBalanceRequest{},
+	)
+	if err != nil {
+		log.Debugf("Unable to get wallet balance: %v", err)
+	} else {
+		pageState.WalletConfirmed = formatAmount(
+			dcrutil.Amount(walletBalance.ConfirmedBalance),
+		)
+		pageState.WalletUnconfirmed = formatAmount(
+			dcrutil.Amount(walletBalance.UnconfirmedBalance),
+		)
+	}
+
+	if capacity, low := l.liquidity.snapshot(); capacity != nil {
+		pageState.MaxReceivable = formatAmount(capacity.MaxReceivable)
+		pageState.InboundLow = low
+	}
+
+	pageState.Tips, err = l.recentTips(time.Now(), adminNumRecentTips)
+	if err != nil {
+		log.Errorf("Unable to list recent tips: %v", err)
+	}
+
+	pageState.Deliveries, err = l.recentDeliveries(adminNumRecentDeliveries)
+	if err != nil {
+		log.Errorf("Unable to list recent webhook deliveries: %v", err)
+	}
+
+	pageState.Closures, err = l.recentClosures(adminNumRecentClosures)
+	if err != nil {
+		log.Errorf("Unable to list recently closed channels: %v", err)
+	}
+
+	pageState.Withdrawals, err = l.pendingWithdrawals()
+	if err != nil {
+		log.Errorf("Unable to list pending withdrawals: %v", err)
+	}
+
+	w.WriteHeader(status)
+	adminTemplate := l.templates.Lookup("admin.html")
+	if err := adminTemplate.Execute(w, pageState); err != nil {
+		log.Errorf("unable to render admin dashboard: %v", err)
+	}
+}
+
+// adminHome renders the admin dashboard.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) adminHome(w http.ResponseWriter, r *http.Request) {
+	session, ok := l.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	l.renderAdmin(w, session, nil, NoError, http.StatusOK)
+}
+
+// adminUpdateSettings changes the runtime settings of the faucet. The
+// changes aren't persisted, so the configured settings are restored on
+// restart.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) adminUpdateSettings(w http.ResponseWriter,
+	r *http.Request) {
+
+	session, ok := l.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	settings := &adminSettings{
+		MinAmount:         r.PostFormValue("min_amount"),
+		MaxAmount:         r.PostFormValue("max_amount"),
+		RateLimitBurst:    r.PostFormValue("ratelimit_burst"),
+		RateLimitInterval: r.PostFormValue("ratelimit_interval"),
+	}
+
+	minAmount, minErr := parseAmount(settings.MinAmount, defaultAmountUnit)
+	maxAmount, maxErr := parseAmount(settings.MaxAmount, defaultAmountUnit)
+	burst, burstErr := strconv.Atoi(settings.RateLimitBurst)
+	interval, intervalErr := time.ParseDuration(settings.RateLimitInterval)
+
+	submissionErr := NoError
+	switch {
+	case minErr != nil || maxErr != nil || minAmount < 1 ||
+		maxAmount < minAmount:
+
+		submissionErr = InvalidAmountLimits
+
+	case burstErr != nil || intervalErr != nil || burst < 1 ||
+		interval <= 0:
+
+		submissionErr = InvalidRateLimit
+	}
+	if submissionErr != NoError {
+		l.renderAdmin(
+			w, session, settings, submissionErr,
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	l.setAmountLimits(minAmount, maxAmount)
+	l.limiter.setRate(burst, interval)
+	log.Infof("Admin set the invoice amounts to between %v and %v and "+
+		"the rate limit to %d invoices every %v", minAmount, maxAmount,
+		burst, interval)
+
+	http.Redirect(w, r, adminPath, http.StatusSeeOther)
+}
+
+// adminPaymentHash decodes the payment hash in the URL of an admin request,
+// writing a not found error to the response if it's invalid.
+func adminPaymentHash(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	rHash, err := hex.DecodeString(mux.Vars(r)["rhash"])
+	if err != nil || len(rHash) != sha256.Size {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	return rHash, true
+}
+
+// adminCancelInvoice cancels the invoice of a tip so it can't be paid
+// anymore.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) adminCancelInvoice(w http.ResponseWriter,
+	r *http.Request) {
+
+	session, ok := l.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	rHash, ok := adminPaymentHash(w, r)
+	if !ok {
+		return
+	}
+
+	// Only the invoices of tips may be canceled, not any invoice of the
+	// node.
+	if _, err := l.store.fetchTip(rHash); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	_, err := l.invoicesClient.CancelInvoice(
+		l.ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: rHash},
+	)
+	if err != nil {
+		log.Errorf("Unable to cancel invoice %x: %v", rHash, err)
+		l.renderAdmin(
+			w, session, nil, CancelInvoiceFailed,
+			apiStatusCode(CancelInvoiceFailed),
+		)
+		return
+	}
+	log.Infof("Admin canceled invoice %x", rHash)
+
+	if _, err := l.invoices.refresh(l.ctx, rHash); err != nil {
+		log.Warnf("Unable to refresh canceled invoice %x: %v", rHash,
+			err)
+	}
+
+	http.Redirect(w, r, adminPath, http.StatusSeeOther)
+}
+
+// adminHideInvoice hides the tip from the public pages, or displays it again
+// when the hidden form field is false.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) adminHideInvoice(w http.ResponseWriter,
+	r *http.Request) {
+
+	_, ok := l.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	rHash, ok := adminPaymentHash(w, r)
+	if !ok {
+		return
+	}
+
+	hidden := r.PostFormValue("hidden") != "false"
+	err := l.store.updateTip(rHash, func(tip *tipRecord) {
+		tip.Hidden = hidden
+	})
+	switch {
+	case err == errTipNotFound:
+		http.NotFound(w, r)
+		return
+
+	case err != nil:
+		log.Errorf("Unable to hide tip %x: %v", rHash, err)
+		http.Error(w, "unable to hide tip",
+			http.StatusInternalServerError)
+		return
+	}
+
+	// The largest tips and the leaderboard may display the tip.
+	l.stats.invalidate()
+
+	if hidden {
+		log.Infof("Admin hid tip %x", rHash)
+	} else {
+		log.Infof("Admin unhid tip %x", rHash)
+	}
+
+	http.Redirect(w, r, adminPath, http.StatusSeeOther)
+}
+
+// adminRetryWebhook queues a webhook delivery which was given up for another
+// round of attempts.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) adminRetryWebhook(w http.ResponseWriter,
+	r *http.Request) {
+
+	_, ok := l.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	endpoint := vars["endpoint"]
+	id, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = l.store.retryDelivery(endpoint, id, time.Now())
+	switch {
+	case err == errDeliveryNotFound:
+		http.NotFound(w, r)
+		return
+
+	// The delivery was already retried, likely by a form submitted
+	// twice.
+	case err == errDeliveryNotFailed:
+
+	case err != nil:
+		log.Errorf("Unable to retry webhook delivery %d: %v", id, err)
+		http.Error(w, "unable to retry webhook delivery",
+			http.StatusInternalServerError)
+		return
+
+	default:
+		log.Infof("Admin retried webhook delivery %d to %s", id,
+			endpoint)
+		l.webhooks.wake()
+	}
+
+	http.Redirect(w, r, adminPath, http.StatusSeeOther)
+}
+
+// adminReleaseWithdrawal records a pending withdrawal as failed, returning
+// its reserved amount to the balance of the recipient. It's meant for the
+// withdrawals the operator found failed before they're released
+// automatically.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) adminReleaseWithdrawal(w http.ResponseWriter,
+	r *http.Request) {
+
+	session, ok := l.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	paymentHash, ok := adminPaymentHash(w, r)
+	if !ok {
+		return
+	}
+
+	withdrawal, err := l.store.fetchWithdrawal(paymentHash)
+	switch {
+	case err == errWithdrawalNotFound:
+		http.NotFound(w, r)
+		return
+
+	case err != nil:
+		log.Errorf("Unable to fetch withdrawal %x: %v", paymentHash, err)
+		http.Error(w, "unable to release withdrawal",
+			http.StatusInternalServerError)
+		return
+
+	// The outcome was recorded in the meantime, or the form was
+	// submitted twice.
+	case withdrawal.State != withdrawalStatePending:
+		http.Redirect(w, r, adminPath, http.StatusSeeOther)
+		return
+	}
+
+	// The withdrawal may still be paid while payWithdrawal waits for
+	// dcrlnd, and otherwise it's only released if dcrlnd doesn't list its
+	// payment as completed, in which case it's recorded as paid instead.
+	now := time.Now()
+	if now.Sub(withdrawal.CreatedAt) <= withdrawalTimeout {
+		l.renderAdmin(
+			w, session, nil, WithdrawalNotReleased,
+			apiStatusCode(WithdrawalNotReleased),
+		)
+		return
+	}
+	payments, err := listPayments(l.ctx, l.lnd)
+	if err != nil {
+		log.Errorf("Unable to list payments to release withdrawal "+
+			"%x: %v", paymentHash, err)
+		l.renderAdmin(
+			w, session, nil, WithdrawalNotReleased,
+			http.StatusBadGateway,
+		)
+		return
+	}
+
+	finished, err := resolveWithdrawal(
+		l.store, withdrawal, payments, "released by the operator", now,
+	)
+	switch {
+	case err == errWithdrawalNotPending:
+
+	case err != nil:
+		log.Errorf("Unable to release withdrawal %x: %v", paymentHash,
+			err)
+		http.Error(w, "unable to release withdrawal",
+			http.StatusInternalServerError)
+		return
+
+	case finished.State == withdrawalStateSucceeded:
+		log.Infof("Admin found withdrawal %x of %s paid, not "+
+			"releasing it", paymentHash, finished.Recipient)
+		logWithdrawalOutcome(finished)
+
+	default:
+		log.Infof("Admin released withdrawal %x of %s", paymentHash,
+			finished.Recipient)
+	}
+
+	http.Redirect(w, r, adminPath, http.StatusSeeOther)
+}
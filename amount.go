@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrd/dcrutil"
+)
+
+const (
+	// defaultAmountUnit is the unit of amounts which don't specify one.
+	defaultAmountUnit = "DCR"
+
+	// milliAtomsPerAtom is the number of milliatoms in an atom.
+	milliAtomsPerAtom = 1000
+)
+
+var (
+	// amountUnits maps the units amounts may be entered in to the number
+	// of decimal places between the unit and milliatoms, the smallest
+	// unit.
+	amountUnits = map[string]int{
+		"dcr":        11,
+		"mdcr":       8,
+		"atoms":      3,
+		"milliatoms": 0,
+	}
+
+	// amountUnitNames are the names of the units, as displayed to users,
+	// in the order they're offered.
+	amountUnitNames = []string{"DCR", "mDCR", "atoms", "milliatoms"}
+
+	// errAmountNotNumber is returned when an amount isn't a plain decimal
+	// number or is given in an unknown unit.
+	errAmountNotNumber = errors.New("amount is not a number")
+
+	// errAmountNegative is returned when an amount is negative.
+	errAmountNegative = errors.New("amount is negative")
+
+	// errAmountTooPrecise is returned when an amount isn't a whole number
+	// of atoms. Invoices are denominated in atoms, so milliatoms are only
+	// accepted in multiples of an atom.
+	errAmountTooPrecise = errors.New("amount is not a whole number of atoms")
+
+	// errAmountTooLarge is returned when an amount exceeds the total
+	// supply of DCR.
+	errAmountTooLarge = errors.New("amount is too large")
+)
+
+// parseAmount parses a decimal amount expressed in unit into atoms. The
+// conversion is exact: amounts are parsed as decimal strings rather than
+// floats, so no precision is lost to rounding. An empty unit means DCR.
+func parseAmount(amt, unit string) (dcrutil.Amount, error) {
+	if unit == "" {
+		unit = defaultAmountUnit
+	}
+	decimals, ok := amountUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, errAmountNotNumber
+	}
+
+	amt = strings.TrimSpace(amt)
+	negative := strings.HasPrefix(amt, "-")
+	amt = strings.TrimPrefix(amt, "-")
+
+	intPart, fracPart := amt, ""
+	if i := strings.IndexByte(amt, '.'); i >= 0 {
+		intPart, fracPart = amt[:i], amt[i+1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return 0, errAmountNotNumber
+	}
+	for _, part := range []string{intPart, fracPart} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, errAmountNotNumber
+			}
+		}
+	}
+
+	// Digits beyond the precision of milliatoms must all be zero.
+	if len(fracPart) > decimals {
+		if strings.Trim(fracPart[decimals:], "0") != "" {
+			return 0, errAmountTooPrecise
+		}
+		fracPart = fracPart[:decimals]
+	}
+	fracPart += strings.Repeat("0", decimals-len(fracPart))
+
+	digits := strings.TrimLeft(intPart+fracPart, "0")
+	if digits == "" {
+		return 0, nil
+	}
+	if negative {
+		return 0, errAmountNegative
+	}
+
+	milliAtoms, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, errAmountTooLarge
+	}
+	if milliAtoms%milliAtomsPerAtom != 0 {
+		return 0, errAmountTooPrecise
+	}
+
+	atoms := dcrutil.Amount(milliAtoms / milliAtomsPerAtom)
+	if atoms > dcrutil.MaxAmount {
+		return 0, errAmountTooLarge
+	}
+
+	return atoms, nil
+}
+
+// formatAmount formats an amount in DCR without losing precision and without
+// trailing zeros.
+func formatAmount(amt dcrutil.Amount) string {
+	sign := ""
+	if amt < 0 {
+		sign = "-"
+		amt = -amt
+	}
+
+	whole := int64(amt) / dcrutil.AtomsPerCoin
+	frac := int64(amt) % dcrutil.AtomsPerCoin
+	if frac == 0 {
+		return sign + strconv.FormatInt(whole, 10)
+	}
+
+	fracStr := strconv.FormatInt(frac+dcrutil.AtomsPerCoin, 10)[1:]
+	return sign + strconv.FormatInt(whole, 10) + "." +
+		strings.TrimRight(fracStr, "0")
+}
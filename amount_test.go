@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/decred/dcrd/dcrutil"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		amt   string
+		unit  string
+		atoms dcrutil.Amount
+		err   error
+	}{
+		// Amounts which can't be represented exactly as floats are
+		// converted without rounding.
+		{"0.29", "DCR", 29000000, nil},
+		{"0.1", "", 10000000, nil},
+		{"1.23456789", "dcr", 123456789, nil},
+		{".5", "DCR", 50000000, nil},
+		{"2.", "DCR", 200000000, nil},
+		{" 0.01 ", "DCR", 1000000, nil},
+		{"0", "DCR", 0, nil},
+		{"-0", "DCR", 0, nil},
+
+		// Each unit.
+		{"1.5", "mDCR", 150000, nil},
+		{"0.00001", "mDCR", 1, nil},
+		{"42", "atoms", 42, nil},
+		{"3000", "milliatoms", 3, nil},
+		{"3", "MilliAtoms", 0, errAmountTooPrecise},
+		{"1", "satoshis", 0, errAmountNotNumber},
+
+		{"-0.01", "DCR", 0, errAmountNegative},
+		{"-1", "atoms", 0, errAmountNegative},
+
+		// Only plain decimal numbers are accepted.
+		{"NaN", "DCR", 0, errAmountNotNumber},
+		{"Inf", "DCR", 0, errAmountNotNumber},
+		{"1e3", "DCR", 0, errAmountNotNumber},
+		{"0x10", "atoms", 0, errAmountNotNumber},
+		{"+1", "DCR", 0, errAmountNotNumber},
+		{"1,5", "DCR", 0, errAmountNotNumber},
+		{"1.2.3", "DCR", 0, errAmountNotNumber},
+		{"", "DCR", 0, errAmountNotNumber},
+		{".", "DCR", 0, errAmountNotNumber},
+
+		// Decimals beyond the precision of the unit must be zeros.
+		{"0.000000001", "DCR", 0, errAmountTooPrecise},
+		{"0.000000010", "DCR", 1, nil},
+		{"1.5", "atoms", 0, errAmountTooPrecise},
+		{"0.5", "milliatoms", 0, errAmountTooPrecise},
+
+		// Amounts above the total supply, or which overflow, are too
+		// large.
+		{"21000000", "DCR", dcrutil.MaxAmount, nil},
+		{"21000000.00000001", "DCR", 0, errAmountTooLarge},
+		{"99999999999999999999", "DCR", 0, errAmountTooLarge},
+		{"99999999999999999999", "milliatoms", 0, errAmountTooLarge},
+	}
+
+	for _, test := range tests {
+		atoms, err := parseAmount(test.amt, test.unit)
+		if err != test.err || atoms != test.atoms {
+			t.Errorf("parseAmount(%q, %q): got (%v, %v), want "+
+				"(%v, %v)", test.amt, test.unit, int64(atoms), err,
+				int64(test.atoms), test.err)
+		}
+	}
+}
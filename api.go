@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// apiPrefix is the path prefix of the current version of the JSON API.
+	apiPrefix = "/api/v1"
+
+	// maxAPIRequestSize is the largest request body accepted by the JSON
+	// API.
+	maxAPIRequestSize = 4096
+)
+
+// apiError is the body returned by the JSON API when a request fails.
+type apiError struct {
+	// Code is a stable identifier of the error. For validation errors
+	// this is the Code of the corresponding chanCreationError.
+	Code string `json:"code"`
+
+	// Message is a human readable description of the error.
+	Message string `json:"message"`
+}
+
+// createInvoiceRequest is the body of a request to create a tip invoice.
+type createInvoiceRequest struct {
+	// Amount is the amount of the invoice. Both JSON numbers and strings
+	// are accepted.
+	Amount json.Number `json:"amount"`
+
+	// Unit is the unit of Amount, one of DCR (default), mDCR, atoms or
+	// milliatoms.
+	Unit string `json:"unit"`
+
+	// Memo is the description of the invoice.
+	Memo string `json:"memo"`
+
+	// Nickname is the name the tipper appears with on the leaderboard of
+	// the stats page. Tippers without one are left off it.
+	Nickname string `json:"nickname"`
+
+	// Recipient is the slug of the recipient of the tip. Tips without one
+	// go to the node operator.
+	Recipient string `json:"recipient"`
+
+	// AnyAmount requests an invoice without an amount, in which case
+	// Amount and Unit are ignored.
+	AnyAmount bool `json:"any_amount"`
+
+	// Expiry is how long in seconds the invoice can be paid, and
+	// CltvExpiry the CLTV delta in blocks of its final hop. The defaults
+	// of the faucet apply when they're zero.
+	Expiry     int64  `json:"expiry"`
+	CltvExpiry uint64 `json:"cltv_expiry"`
+
+	// Private and FallbackAddr override whether the invoice carries route
+	// hints for the private channels and an on-chain fallback address.
+	Private      *bool `json:"private"`
+	FallbackAddr *bool `json:"fallback_addr"`
+}
+
+// invoiceStatusResponse is the JSON representation of a tracked invoice.
+type invoiceStatusResponse struct {
+	RHash          string        `json:"rhash"`
+	AddIndex       uint64        `json:"add_index"`
+	SettleIndex    uint64        `json:"settle_index,omitempty"`
+	Status         invoiceStatus `json:"status"`
+	ValueAtoms     int64         `json:"value_atoms"`
+	AmtPaidAtoms   int64         `json:"amt_paid_atoms"`
+	Memo           string        `json:"memo"`
+	PaymentRequest string        `json:"payment_request"`
+	CreationDate   int64         `json:"creation_date"`
+	ExpiresAt      int64         `json:"expires_at"`
+	SettleDate     int64         `json:"settle_date,omitempty"`
+}
+
+// newInvoiceStatusResponse returns the JSON representation of the invoice.
+func newInvoiceStatusResponse(invoice *trackedInvoice) *invoiceStatusResponse {
+	resp := &invoiceStatusResponse{
+		RHash:          hex.EncodeToString(invoice.RHash),
+		AddIndex:       invoice.AddIndex,
+		SettleIndex:    invoice.SettleIndex,
+		Status:         invoice.status(time.Now()),
+		ValueAtoms:     invoice.Value,
+		AmtPaidAtoms:   invoice.AmtPaidAtoms,
+		Memo:           invoice.Memo,
+		PaymentRequest: invoice.PaymentRequest,
+		CreationDate:   invoice.CreationDate.Unix(),
+		ExpiresAt:      invoice.expiresAt().Unix(),
+	}
+	if !invoice.SettleDate.IsZero() {
+		resp.SettleDate = invoice.SettleDate.Unix()
+	}
+
+	return resp
+}
+
+// nodeInfoResponse is the JSON representation of the node backing the
+// faucet.
+type nodeInfoResponse struct {
+	Pubkey            string   `json:"pubkey"`
+	Alias             string   `json:"alias"`
+	URIs              []string `json:"uris"`
+	Version           string   `json:"version"`
+	BlockHeight       uint32   `json:"block_height"`
+	SyncedToChain     bool     `json:"synced_to_chain"`
+	NumActiveChannels uint32   `json:"num_active_channels"`
+	NumPeers          uint32   `json:"num_peers"`
+	UpdatedAt         int64    `json:"updated_at"`
+
+	// Reachable indicates whether the node can currently be reached. The
+	// other fields describe the node as of UpdatedAt.
+	Reachable bool `json:"reachable"`
+}
+
+// writeJSON writes v as the JSON body of the response with the given status
+// code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("unable to encode API response: %v", err)
+	}
+}
+
+// writeAPIError writes an apiError with the given status code.
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, &apiError{Code: code, Message: message})
+}
+
+// apiStatusCode returns the HTTP status code used by the JSON API to report
+// the given chanCreationError.
+func apiStatusCode(c chanCreationError) int {
+	switch c {
+	case NoError:
+		return http.StatusOK
+	case InvoiceTimeNotElapsed, TooManyAttempts:
+		return http.StatusTooManyRequests
+	case InvalidPayoutToken, InvalidCredentials:
+		return http.StatusUnauthorized
+	case UnknownRecipient:
+		return http.StatusNotFound
+	case NodeNotSynced, NodeUnavailable, InsufficientInboundCapacity:
+		return http.StatusServiceUnavailable
+	case HaveChannel, HavePendingChannel, WithdrawalNotReleased:
+		return http.StatusConflict
+	case ErrorGeneratingInvoice, CancelInvoiceFailed, ChannelOpenFail:
+		return http.StatusBadGateway
+	case WithdrawalFailed:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// apiPaymentHash decodes the payment hash in the URL of an API request,
+// writing an error to the response if it's invalid.
+func apiPaymentHash(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	rHash, err := hex.DecodeString(mux.Vars(r)["rhash"])
+	if err != nil || len(rHash) != sha256.Size {
+		writeAPIError(w, http.StatusBadRequest, "invalid_payment_hash",
+			"payment hash must be 32 hex encoded bytes")
+		return nil, false
+	}
+
+	return rHash, true
+}
+
+// apiCreateInvoice creates a new tip invoice from a JSON createInvoiceRequest
+// applying the same validation as the HTML form.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) apiCreateInvoice(w http.ResponseWriter, r *http.Request) {
+	var req createInvoiceRequest
+	body := http.MaxBytesReader(w, r.Body, maxAPIRequestSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request",
+			"request body must be a JSON object")
+		return
+	}
+
+	if submissionErr := l.limitInvoiceRequest(w, r); submissionErr != NoError {
+		writeAPIError(w, apiStatusCode(submissionErr),
+			submissionErr.Code(), submissionErr.String())
+		return
+	}
+
+	invoice, submissionErr := l.createInvoice(&invoiceRequest{
+		Amount:     req.Amount.String(),
+		Unit:       req.Unit,
+		Memo:       req.Memo,
+		Nickname:   req.Nickname,
+		Recipient:  req.Recipient,
+		RemoteAddr: l.limiter.clientIP(r).String(),
+		UserAgent:  r.UserAgent(),
+		AnyAmount:  req.AnyAmount,
+
+		Expiry:       req.Expiry,
+		CltvExpiry:   req.CltvExpiry,
+		Private:      req.Private,
+		FallbackAddr: req.FallbackAddr,
+	})
+	if submissionErr != NoError {
+		writeAPIError(w, apiStatusCode(submissionErr),
+			submissionErr.Code(), submissionErr.String())
+		return
+	}
+
+	location := apiPrefix + "/invoices/" + hex.EncodeToString(invoice.RHash)
+	w.Header().Set("Location", location)
+
+	// Lookup the invoice so the response carries the same information as
+	// a status request. Should that fail, the invoice was still created
+	// so the essential fields are returned anyway.
+	tracked, err := l.invoices.lookup(l.ctx, invoice.RHash)
+	if err != nil {
+		log.Warnf("Unable to lookup created invoice %x: %v",
+			invoice.RHash, err)
+		writeJSON(w, http.StatusCreated, &invoiceStatusResponse{
+			RHash:          hex.EncodeToString(invoice.RHash),
+			AddIndex:       invoice.AddIndex,
+			Status:         invoiceStatusOpen,
+			PaymentRequest: invoice.PaymentRequest,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newInvoiceStatusResponse(tracked))
+}
+
+// apiInvoiceStatus returns the current status of the invoice identified by
+// the payment hash in the URL.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) apiInvoiceStatus(w http.ResponseWriter, r *http.Request) {
+	rHash, ok := apiPaymentHash(w, r)
+	if !ok {
+		return
+	}
+
+	if _, ok := l.visibleTip(rHash); !ok {
+		writeAPIError(w, http.StatusNotFound, "invoice_not_found",
+			"invoice not found")
+		return
+	}
+
+	invoice, err := l.invoices.lookup(l.ctx, rHash)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "invoice_not_found",
+			"invoice not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newInvoiceStatusResponse(invoice))
+}
+
+// apiNodeInfo returns information about the node receiving the tips.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) apiNodeInfo(w http.ResponseWriter, r *http.Request) {
+	info := l.nodeInfo.snapshot()
+	if info == nil {
+		writeAPIError(w, http.StatusServiceUnavailable,
+			"node_info_unavailable", "node info is not available")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &nodeInfoResponse{
+		Pubkey:            info.Pubkey,
+		Alias:             info.Alias,
+		URIs:              info.URIs,
+		Version:           info.Version,
+		BlockHeight:       info.BlockHeight,
+		SyncedToChain:     info.SyncedToChain,
+		NumActiveChannels: info.NumActiveChannels,
+		NumPeers:          info.NumPeers,
+		UpdatedAt:         info.Updated.Unix(),
+		Reachable:         !l.breaker.isOpen(),
+	})
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	"github.com/decred/dcrd/dcrutil"
+	"github.com/decred/dcrlnd/lnrpc"
+)
+
+const (
+	// faucetModeTip is the faucet mode where visitors may only tip the
+	// node.
+	faucetModeTip = "tip"
+
+	// faucetModeOpenChannel is the faucet mode where visitors may also ask
+	// the faucet to open a channel to their node.
+	faucetModeOpenChannel = "openchannel"
+)
+
+// openChannelRequest is the body of a request to open a channel through the
+// JSON API.
+type openChannelRequest struct {
+	// Node is the pubkey of the node to open the channel to, optionally
+	// followed by @host:port to have the faucet connect to it.
+	Node string `json:"node"`
+
+	// Amount is the capacity of the channel in DCR.
+	Amount json.Number `json:"amount"`
+
+	// PushAmount is the amount in DCR initially given to the node on its
+	// side of the channel.
+	PushAmount json.Number `json:"push_amount"`
+}
+
+// openChannelResponse is the JSON representation of a channel opened by the
+// faucet.
+type openChannelResponse struct {
+	ChannelPoint  string `json:"channel_point"`
+	Node          string `json:"node"`
+	CapacityAtoms int64  `json:"capacity_atoms"`
+	PushAtoms     int64  `json:"push_atoms"`
+}
+
+// channelRequest describes a channel requested through the form or the JSON
+// API.
+type channelRequest struct {
+	// Node is the pubkey of the node, optionally followed by @host:port.
+	Node string
+
+	// Amount and PushAmount are the capacity of the channel and the amount
+	// pushed to the node, in DCR. An empty PushAmount pushes nothing.
+	Amount     string
+	PushAmount string
+
+	// RemoteAddr identifies the client requesting the channel.
+	RemoteAddr string
+}
+
+// openedChannel is a channel opened by the faucet.
+type openedChannel struct {
+	channelPoint string
+	nodePubkey   string
+	capacity     dcrutil.Amount
+	push         dcrutil.Amount
+}
+
+// parseNodeAddress parses a node pubkey, optionally followed by @host:port,
+// returning the hex encoded pubkey and the host, empty if none was given.
+func parseNodeAddress(node string) (string, string, error) {
+	pubkeyStr, host := strings.TrimSpace(node), ""
+	if i := strings.Index(pubkeyStr, "@"); i >= 0 {
+		pubkeyStr, host = pubkeyStr[:i], pubkeyStr[i+1:]
+		if host == "" {
+			return "", "", fmt.Errorf("missing host in %q", node)
+		}
+	}
+
+	pubkey, err := hex.DecodeString(pubkeyStr)
+	if err != nil {
+		return "", "", err
+	}
+	if len(pubkey) != secp256k1.PubKeyBytesLenCompressed {
+		return "", "", fmt.Errorf("pubkey must be %d bytes long",
+			secp256k1.PubKeyBytesLenCompressed)
+	}
+	if _, err := secp256k1.ParsePubKey(pubkey); err != nil {
+		return "", "", err
+	}
+
+	return strings.ToLower(pubkeyStr), host, nil
+}
+
+// channelPointString returns the funding outpoint of the channel as
+// txid:index.
+func channelPointString(chanPoint *lnrpc.ChannelPoint) (string, error) {
+	txid := chanPoint.GetFundingTxidStr()
+	if txid == "" {
+		hash, err := chainhash.NewHash(chanPoint.GetFundingTxidBytes())
+		if err != nil {
+			return "", err
+		}
+		txid = hash.String()
+	}
+
+	return fmt.Sprintf("%s:%d", txid, chanPoint.OutputIndex), nil
+}
+
+// openChannel validates the requested node and amounts and, if they check
+// out, opens a channel to the node. Only a single channel is opened to each
+// node, so nodes which already have an open or pending channel with the
+// faucet are refused. This is shared by the HTML form and the JSON API so
+// both apply the same rules.
+func (l *lightningFaucet) openChannel(
+	req *channelRequest) (*openedChannel, chanCreationError) {
+
+	if l.nodeInfo.notSynced() {
+		return nil, NodeNotSynced
+	}
+
+	pubkey, host, err := parseNodeAddress(req.Node)
+	if err != nil {
+		return nil, InvalidAddress
+	}
+
+	capacity, err := parseAmount(req.Amount, defaultAmountUnit)
+	switch {
+	case err == errAmountTooLarge:
+		return nil, ChannelTooLarge
+	case err != nil:
+		return nil, ChanAmountNotNumber
+	case int64(capacity) < minChannelSize:
+		return nil, ChannelTooSmall
+	case int64(capacity) > maxChannelSize:
+		return nil, ChannelTooLarge
+	}
+
+	var push dcrutil.Amount
+	if req.PushAmount != "" {
+		push, err = parseAmount(req.PushAmount, defaultAmountUnit)
+		if err != nil {
+			return nil, PushIncorrect
+		}
+	}
+	if push >= capacity {
+		return nil, PushIncorrect
+	}
+
+	// Checking for existing channels and opening the new one must be
+	// atomic, otherwise concurrent requests could open several channels
+	// to the same node.
+	l.openChanMtx.Lock()
+	defer l.openChanMtx.Unlock()
+
+	if submissionErr := l.connectNode(pubkey, host); submissionErr != NoError {
+		return nil, submissionErr
+	}
+
+	channels, err := l.lnd.ListChannels(
+		l.ctx, &lnrpc.ListChannelsRequest{},
+	)
+	if err != nil {
+		log.Errorf("Unable to list channels: %v", err)
+		return nil, channelRPCError(err)
+	}
+	for _, channel := range channels.Channels {
+		if channel.RemotePubkey == pubkey {
+			return nil, HaveChannel
+		}
+	}
+
+	pending, err := l.lnd.PendingChannels(
+		l.ctx, &lnrpc.PendingChannelsRequest{},
+	)
+	if err != nil {
+		log.Errorf("Unable to list pending channels: %v", err)
+		return nil, channelRPCError(err)
+	}
+	for _, channel := range pending.PendingOpenChannels {
+		if channel.Channel != nil &&
+			channel.Channel.RemoteNodePub == pubkey {
+
+			return nil, HavePendingChannel
+		}
+	}
+
+	pubkeyBytes, _ := hex.DecodeString(pubkey)
+	chanPoint, err := l.lnd.OpenChannelSync(l.ctx, &lnrpc.OpenChannelRequest{
+		NodePubkey:         pubkeyBytes,
+		LocalFundingAmount: int64(capacity),
+		PushAtoms:          int64(push),
+	})
+	if err != nil {
+		log.Errorf("Unable to open channel to %s: %v", pubkey, err)
+		return nil, channelRPCError(err)
+	}
+
+	chanPointStr, err := channelPointString(chanPoint)
+	if err != nil {
+		// The channel is being opened anyway, so only the funding
+		// outpoint can't be displayed.
+		log.Warnf("Invalid funding outpoint of channel to %s: %v",
+			pubkey, err)
+	}
+
+	channelsOpened.inc()
+	log.Infof("Opened channel %s to %s from %s with %v, pushing %v",
+		chanPointStr, pubkey, req.RemoteAddr, capacity, push)
+
+	return &openedChannel{
+		channelPoint: chanPointStr,
+		nodePubkey:   pubkey,
+		capacity:     capacity,
+		push:         push,
+	}, NoError
+}
+
+// connectNode makes sure the faucet is connected to the node, connecting to
+// the given host if any. Without a host, the node must already be connected.
+func (l *lightningFaucet) connectNode(pubkey, host string) chanCreationError {
+	if host != "" {
+		_, err := l.lnd.ConnectPeer(l.ctx, &lnrpc.ConnectPeerRequest{
+			Addr: &lnrpc.LightningAddress{
+				Pubkey: pubkey,
+				Host:   host,
+			},
+		})
+		switch {
+		case err == nil:
+			return NoError
+
+		// Being connected already is just as good.
+		case strings.Contains(err.Error(), "already connected"):
+			return NoError
+
+		case isNodeUnavailable(err):
+			return NodeUnavailable
+
+		default:
+			log.Debugf("Unable to connect to %s@%s: %v", pubkey,
+				host, err)
+			return NotConnected
+		}
+	}
+
+	peers, err := l.lnd.ListPeers(l.ctx, &lnrpc.ListPeersRequest{})
+	if err != nil {
+		log.Errorf("Unable to list peers: %v", err)
+		return channelRPCError(err)
+	}
+	for _, peer := range peers.Peers {
+		if peer.PubKey == pubkey {
+			return NoError
+		}
+	}
+
+	return NotConnected
+}
+
+// channelRPCError returns the chanCreationError reporting a failed request to
+// dcrlnd while opening a channel.
+func channelRPCError(err error) chanCreationError {
+	if isNodeUnavailable(err) {
+		return NodeUnavailable
+	}
+
+	return ChannelOpenFail
+}
+
+// limitChannelRequest consumes a rate limiting token for the client issuing
+// the request. Channels are limited along with the invoices, so a client
+// can't get around the rate limit by alternating between them.
+func (l *lightningFaucet) limitChannelRequest(w http.ResponseWriter,
+	r *http.Request) chanCreationError {
+
+	allowed, wait := l.limiter.allow(r)
+	if !allowed {
+		log.Debugf("Rate limited channel request from %s",
+			l.limiter.clientIP(r))
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		rateLimited.inc()
+		return TooManyAttempts
+	}
+
+	return NoError
+}
+
+// openChannelForm is a hybrid http.Handler that handles: the validation of
+// the open channel form, rendering errors to the form, and finally opening
+// the channel if all the parameters check out.
+func (l *lightningFaucet) openChannelForm(homeTemplate *template.Template,
+	homeState *homePageContext, w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "unable to parse form", 500)
+		return
+	}
+
+	homeState.ChannelRequested = true
+	homeState.FormFields["Node"] = r.FormValue("node")
+	homeState.FormFields["ChanAmt"] = r.FormValue("chan_amt")
+	homeState.FormFields["PushAmt"] = r.FormValue("push_amt")
+
+	submissionErr := l.limitChannelRequest(w, r)
+	if submissionErr == NoError {
+		var channel *openedChannel
+		channel, submissionErr = l.openChannel(&channelRequest{
+			Node:       r.FormValue("node"),
+			Amount:     r.FormValue("chan_amt"),
+			PushAmount: r.FormValue("push_amt"),
+			RemoteAddr: l.limiter.clientIP(r).String(),
+		})
+		if submissionErr == NoError {
+			homeState.ChannelPoint = channel.channelPoint
+		}
+	}
+
+	homeState.SubmissionError = submissionErr
+	w.WriteHeader(apiStatusCode(submissionErr))
+	if err := homeTemplate.Execute(w, homeState); err != nil {
+		log.Errorf("unable to render home page: %v", err)
+	}
+}
+
+// apiOpenChannel opens a channel from a JSON openChannelRequest applying the
+// same validation as the HTML form.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) apiOpenChannel(w http.ResponseWriter, r *http.Request) {
+	if !l.openChannels {
+		writeAPIError(w, http.StatusNotFound, "not_found",
+			"opening channels is disabled")
+		return
+	}
+
+	var req openChannelRequest
+	body := http.MaxBytesReader(w, r.Body, maxAPIRequestSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request",
+			"request body must be a JSON object")
+		return
+	}
+
+	if submissionErr := l.limitChannelRequest(w, r); submissionErr != NoError {
+		writeAPIError(w, apiStatusCode(submissionErr),
+			submissionErr.Code(), submissionErr.String())
+		return
+	}
+
+	channel, submissionErr := l.openChannel(&channelRequest{
+		Node:       req.Node,
+		Amount:     req.Amount.String(),
+		PushAmount: req.PushAmount.String(),
+		RemoteAddr: l.limiter.clientIP(r).String(),
+	})
+	if submissionErr != NoError {
+		writeAPIError(w, apiStatusCode(submissionErr),
+			submissionErr.Code(), submissionErr.String())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &openChannelResponse{
+		ChannelPoint:  channel.channelPoint,
+		Node:          channel.nodePubkey,
+		CapacityAtoms: int64(channel.capacity),
+		PushAtoms:     int64(channel.push),
+	})
+}
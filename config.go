@@ -1,38 +1,79 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/decred/dcrd/dcrutil"
+	"github.com/golang/crypto/bcrypt"
 	"github.com/jessevdk/go-flags"
 )
 
 const (
 	defaultTLSCertFilename  = "tls.cert"
-	defaultMacaroonFilename = "admin.macaroon"
+	defaultMacaroonFilename = "invoice.macaroon"
 	defaultLogFilename      = "dcrtippin.log"
 	defaultConfigFilename   = "dcrtippin.conf"
+	legacyCursorFilename    = "invoicecursor.json"
 	defaultLogLevel         = "info"
 	defaultLndNode          = "localhost:10009"
 	defaultBindAddr         = ":8000"
 	defaultUseLeHTTPS       = false
+
+	defaultRateLimitBurst      = 3
+	defaultRateLimitInterval   = time.Minute
+	defaultGlobalLimitBurst    = 60
+	defaultGlobalLimitInterval = time.Second
+
+	defaultWithdrawLimitBurst    = 5
+	defaultWithdrawLimitInterval = time.Minute
+
+	defaultMaxEventStreams = 4
+
+	defaultNodeInfoInterval = time.Minute
+
+	defaultLiquidityInterval = time.Minute
+
+	defaultShutdownTimeout = 10 * time.Second
+
+	defaultLndRPCTimeout      = 10 * time.Second
+	defaultLndKeepalive       = 5 * time.Minute
+	defaultLndMaxBackoff      = 30 * time.Second
+	defaultLndBreakerFailures = 3
+	defaultLndBreakerCooldown = 30 * time.Second
+
+	defaultMinAmount = "0.00000001"
+	defaultMaxAmount = "0.2"
+
+	defaultMaxInvoiceExpiry = 24 * time.Hour
+
+	defaultFaucetMode = faucetModeTip
+
+	defaultReaperInterval         = 10 * time.Minute
+	defaultMaxChannels            = 100
+	defaultChannelMaxAge          = 8064
+	defaultChannelInactiveTimeout = 24 * time.Hour
+	defaultChannelForceCloseGrace = 72 * time.Hour
+
+	defaultStatsMemos           = "none"
+	defaultStatsLeaderboardSize = 10
+
+	defaultMinWithdrawal    = "0.0001"
+	defaultMaxWithdrawal    = "1"
+	defaultWithdrawalMaxFee = 1
+
+	defaultAdminSessionTimeout = 30 * time.Minute
 )
 
 var (
-	lndHomeDir          = dcrutil.AppDataDir("dcrlnd", false)
-	tlsCertPath         = filepath.Join(lndHomeDir, defaultTLSCertFilename)
-	defaultMacaroonPath = filepath.Join(
-		lndHomeDir, "data", "chain", "decred", "testnet",
-		defaultMacaroonFilename,
-	)
-	defaultDataDir = dcrutil.AppDataDir("dcrtippin", false)
-	defaultLogPath = filepath.Join(
-		defaultDataDir, "logs", "decred", "testnet",
-		defaultLogFilename,
-	)
+	lndHomeDir        = dcrutil.AppDataDir("dcrlnd", false)
+	defaultDataDir    = dcrutil.AppDataDir("dcrtippin", false)
 	defaultConfigFile = filepath.Join(
 		defaultDataDir, defaultConfigFilename,
 	)
@@ -43,14 +84,145 @@ type config struct {
 	BindAddr   string `long:"bind_addr" description:"port to listen for http"`
 	UseLeHTTPS bool   `long:"use_le_https" description:"use https via lets encrypt"`
 	Domain     string `long:"domain" description:"the domain of the faucet, required for TLS"`
+	PublicURL  string `long:"public_url" description:"the base URL where visitors reach the faucet, used in the links of the tip button and widgets (default: https://<domain> when using Let's Encrypt, otherwise http://localhost:<port>)"`
+
+	WidgetsFile    string `long:"widgets_file" description:"path to a JSON file describing the embeddable widgets"`
+	RecipientsFile string `long:"recipients_file" description:"path to a JSON file describing the recipients hosted by the faucet"`
+	WebhooksFile   string `long:"webhooks_file" description:"path to a JSON file describing the webhooks notified when tips are settled"`
+
+	LndDir       string `long:"lnddir" description:"the base directory of dcrlnd, used to find the TLS certificate and macaroon"`
+	TLSCertPath  string `long:"tlscertpath" description:"path to dcrlnd's TLS certificate, defaults to tls.cert within lnddir"`
+	MacaroonPath string `long:"macaroonpath" description:"path to the macaroon used to authenticate with dcrlnd, defaults to the invoice macaroon of the selected network within lnddir"`
+
+	AllowAdminMacaroon bool `long:"allow_admin_macaroon" description:"allow using a macaroon that can move the funds of the node, such as admin.macaroon"`
+
+	FaucetMode string `long:"faucet_mode" description:"tip to only receive tips, or openchannel to also open channels to the nodes of visitors, which requires allow_admin_macaroon and a macaroon with the onchain:write, offchain:read, offchain:write, peers:read and peers:write permissions"`
+
+	ReaperInterval         time.Duration `long:"reaper_interval" description:"how often the channels opened in the openchannel mode are checked for closing, 0 disables closing them"`
+	MaxChannels            int           `long:"max_channels" description:"number of channels opened to visitors kept open, the oldest ones above it are closed"`
+	ChannelMaxAge          uint32        `long:"channel_max_age" description:"number of blocks after which a channel opened to a visitor is closed, 0 for no limit"`
+	ChannelInactiveTimeout time.Duration `long:"channel_inactive_timeout" description:"how long the node of a visitor may stay offline before its channel is closed, 0 for no limit"`
+	ChannelForceCloseGrace time.Duration `long:"channel_force_close_grace" description:"how long a channel is closed cooperatively before it's force closed, 0 to never force close channels"`
+
+	LndRPCTimeout      time.Duration `long:"lnd_rpc_timeout" description:"deadline of each request to dcrlnd"`
+	LndKeepalive       time.Duration `long:"lnd_keepalive" description:"interval between keepalive pings on the connection to dcrlnd, should not be below the minimum allowed by dcrlnd (5m by default)"`
+	LndMaxBackoff      time.Duration `long:"lnd_max_backoff" description:"maximum delay between attempts to reconnect to dcrlnd"`
+	LndBreakerFailures int           `long:"lnd_breaker_failures" description:"number of consecutive failures to reach dcrlnd after which requests fail immediately"`
+	LndBreakerCooldown time.Duration `long:"lnd_breaker_cooldown" description:"how long requests fail immediately before dcrlnd is tried again"`
+
+	MainNet bool `long:"mainnet" description:"use the main network"`
+	TestNet bool `long:"testnet" description:"use the test network (default)"`
+	SimNet  bool `long:"simnet" description:"use the simulation test network"`
+
+	RateLimitBurst      int           `long:"ratelimit_burst" description:"number of invoices a single client may generate in a burst"`
+	RateLimitInterval   time.Duration `long:"ratelimit_interval" description:"time it takes a client to earn an additional invoice"`
+	GlobalLimitBurst    int           `long:"globallimit_burst" description:"number of invoices all clients combined may generate in a burst, 0 disables the global limit"`
+	GlobalLimitInterval time.Duration `long:"globallimit_interval" description:"time it takes all clients combined to earn an additional invoice"`
+	TrustedProxies      []string      `long:"trusted_proxy" description:"IP or CIDR of a reverse proxy whose X-Forwarded-For header is trusted, may be specified multiple times"`
+
+	WithdrawLimitBurst    int           `long:"withdrawlimit_burst" description:"number of balance checks and withdrawals a single client may attempt in a burst"`
+	WithdrawLimitInterval time.Duration `long:"withdrawlimit_interval" description:"time it takes a client to earn an additional balance check or withdrawal"`
+
+	MaxEventStreams int `long:"max_event_streams" description:"number of invoice status streams a single client may keep open"`
+
+	NodeInfoInterval time.Duration `long:"nodeinfo_interval" description:"how often to refresh the identity and sync state of dcrlnd"`
+
+	CheckLiquidity        bool          `long:"check_liquidity" description:"refuse invoices the channels of dcrlnd can't receive, which requires a macaroon with the offchain:read permission"`
+	LiquidityInterval     time.Duration `long:"liquidity_interval" description:"how often to check the inbound capacity of the channels of dcrlnd"`
+	InboundAlertThreshold string        `long:"inbound_alert_threshold" description:"amount in DCR below which the largest payment the node can receive is logged as a warning, defaults to max_amount, 0 disables the alert"`
+
+	ShutdownTimeout time.Duration `long:"shutdown_timeout" description:"how long to wait for in-flight requests to complete when shutting down"`
+
+	MinAmount string `long:"min_amount" description:"smallest amount in DCR of the invoices"`
+	MaxAmount string `long:"max_amount" description:"largest amount in DCR of the invoices"`
+
+	InvoiceExpiry       time.Duration `long:"invoice_expiry" description:"how long the invoices can be paid"`
+	MaxInvoiceExpiry    time.Duration `long:"max_invoice_expiry" description:"longest expiry which may be requested for an invoice through the JSON API"`
+	InvoiceCltvExpiry   uint64        `long:"invoice_cltv_expiry" description:"CLTV delta in blocks of the final hop of the invoices, 0 uses the default of dcrlnd"`
+	InvoicePrivate      bool          `long:"invoice_private" description:"add route hints for the private channels of the node to the invoices, so it can be paid without public channels"`
+	InvoiceFallbackAddr bool          `long:"invoice_fallback_addr" description:"add an on-chain fallback address to the invoices, which requires a macaroon with the address:write permission"`
+
+	OpenAmount bool `long:"open_amount" description:"allow invoices without an amount, letting tippers choose how much to pay from their wallet"`
+
+	StatsMemos           string `long:"stats_memos" description:"which memos of the settled tips are shown on the public stats page: none, leaderboard (only those of tippers who gave a nickname) or all"`
+	StatsLeaderboardSize int    `long:"stats_leaderboard_size" description:"number of tippers ranked on the leaderboard of the stats page, 0 disables the leaderboard"`
+
+	EnableWithdrawals bool   `long:"enable_withdrawals" description:"allow recipients to withdraw their balance over Lightning, requires allow_admin_macaroon and a macaroon with the offchain:write permission"`
+	MinWithdrawal     string `long:"min_withdrawal" description:"smallest amount in DCR of a withdrawal"`
+	MaxWithdrawal     string `long:"max_withdrawal" description:"largest amount in DCR of a withdrawal"`
+	WithdrawalMaxFee  int64  `long:"withdrawal_max_fee" description:"largest routing fee of a withdrawal, in percent of its amount"`
+
+	AdminPasswordHash   string        `long:"admin_password_hash" description:"bcrypt hash of the password of the admin dashboard, as output by the hashpassword command; the dashboard is disabled unless this or admin_totp_secret is set"`
+	AdminTOTPSecret     string        `long:"admin_totp_secret" description:"base32 encoded secret of the one-time passwords (RFC 6238) required to log into the admin dashboard"`
+	AdminSessionTimeout time.Duration `long:"admin_session_timeout" description:"how long an admin session stays valid without activity"`
+
+	// network is the name of the selected network as used by dcrlnd in
+	// its directory names.
+	network string
+
+	// dataDir is the directory where the state of the faucet on the
+	// selected network is stored.
+	dataDir string
+
+	// minAmount and maxAmount are MinAmount and MaxAmount parsed into
+	// atoms.
+	minAmount dcrutil.Amount
+	maxAmount dcrutil.Amount
+
+	// inboundAlertThreshold is InboundAlertThreshold parsed into atoms.
+	inboundAlertThreshold dcrutil.Amount
+
+	// statsMemos is StatsMemos parsed.
+	statsMemos memoVisibility
+
+	// minWithdrawal and maxWithdrawal are MinWithdrawal and MaxWithdrawal
+	// parsed into atoms.
+	minWithdrawal dcrutil.Amount
+	maxWithdrawal dcrutil.Amount
+
+	// adminTOTPSecret is AdminTOTPSecret decoded.
+	adminTOTPSecret []byte
 }
 
 func loadConfig() (*config, []string, error) {
 	// Default config.
 	cfg := config{
-		LndNode:    defaultLndNode,
-		BindAddr:   defaultBindAddr,
-		UseLeHTTPS: defaultUseLeHTTPS,
+		LndNode:               defaultLndNode,
+		LndDir:                lndHomeDir,
+		BindAddr:              defaultBindAddr,
+		UseLeHTTPS:            defaultUseLeHTTPS,
+		RateLimitBurst:        defaultRateLimitBurst,
+		RateLimitInterval:     defaultRateLimitInterval,
+		GlobalLimitBurst:      defaultGlobalLimitBurst,
+		GlobalLimitInterval:   defaultGlobalLimitInterval,
+		WithdrawLimitBurst:    defaultWithdrawLimitBurst,
+		WithdrawLimitInterval: defaultWithdrawLimitInterval,
+		MaxEventStreams:       defaultMaxEventStreams,
+		NodeInfoInterval:      defaultNodeInfoInterval,
+		LiquidityInterval:     defaultLiquidityInterval,
+		ShutdownTimeout:       defaultShutdownTimeout,
+		LndRPCTimeout:         defaultLndRPCTimeout,
+		LndKeepalive:          defaultLndKeepalive,
+		LndMaxBackoff:         defaultLndMaxBackoff,
+		LndBreakerFailures:    defaultLndBreakerFailures,
+		LndBreakerCooldown:    defaultLndBreakerCooldown,
+		MinAmount:             defaultMinAmount,
+		MaxAmount:             defaultMaxAmount,
+		InvoiceExpiry:         defaultInvoiceExpiry,
+		MaxInvoiceExpiry:      defaultMaxInvoiceExpiry,
+		StatsMemos:            defaultStatsMemos,
+		StatsLeaderboardSize:  defaultStatsLeaderboardSize,
+		MinWithdrawal:         defaultMinWithdrawal,
+		MaxWithdrawal:         defaultMaxWithdrawal,
+		WithdrawalMaxFee:      defaultWithdrawalMaxFee,
+		AdminSessionTimeout:   defaultAdminSessionTimeout,
+		FaucetMode:            defaultFaucetMode,
+
+		ReaperInterval:         defaultReaperInterval,
+		MaxChannels:            defaultMaxChannels,
+		ChannelMaxAge:          defaultChannelMaxAge,
+		ChannelInactiveTimeout: defaultChannelInactiveTimeout,
+		ChannelForceCloseGrace: defaultChannelForceCloseGrace,
 	}
 
 	// Pre-parse the command line options to see if an alternative config
@@ -95,9 +267,71 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
-	// Create the home directory if it doesn't already exist.
+	// Select the network. Testnet is used unless another network is
+	// requested.
 	funcName := "loadConfig"
-	err = os.MkdirAll(defaultDataDir, 0700)
+	numNets := 0
+	cfg.network = "testnet"
+	if cfg.MainNet {
+		numNets++
+		cfg.network = "mainnet"
+	}
+	if cfg.TestNet {
+		numNets++
+		cfg.network = "testnet"
+	}
+	if cfg.SimNet {
+		numNets++
+		cfg.network = "simnet"
+	}
+	if numNets > 1 {
+		err := fmt.Errorf("%s: the mainnet, testnet and simnet params "+
+			"can't be used together -- choose one of the three",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	// Unless they were explicitly set, the TLS certificate and the
+	// macaroon are located within the dcrlnd directory.
+	cfg.LndDir = cleanAndExpandPath(cfg.LndDir)
+	if cfg.TLSCertPath == "" {
+		cfg.TLSCertPath = filepath.Join(
+			cfg.LndDir, defaultTLSCertFilename,
+		)
+	}
+	if cfg.MacaroonPath == "" {
+		cfg.MacaroonPath = filepath.Join(
+			cfg.LndDir, "data", "chain", "decred", cfg.network,
+			defaultMacaroonFilename,
+		)
+	}
+	cfg.TLSCertPath = cleanAndExpandPath(cfg.TLSCertPath)
+	cfg.MacaroonPath = cleanAndExpandPath(cfg.MacaroonPath)
+
+	// Only the commands connecting to dcrlnd need its files, and baking a
+	// macaroon authenticates with the admin macaroon instead.
+	var lndFiles []string
+	switch {
+	case len(remainingArgs) == 0:
+		lndFiles = []string{cfg.TLSCertPath, cfg.MacaroonPath}
+	case remainingArgs[0] == "bakemacaroon":
+		lndFiles = []string{cfg.TLSCertPath}
+	}
+	for _, path := range lndFiles {
+		if _, err := os.Stat(path); err != nil {
+			err := fmt.Errorf("%s: unable to access %s: %v",
+				funcName, path, err)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+	}
+
+	// Create the data directory of the selected network if it doesn't
+	// already exist.
+	cfg.dataDir = filepath.Join(defaultDataDir, "data", cfg.network)
+	err = os.MkdirAll(cfg.dataDir, 0700)
 	if err != nil {
 		// Show a nicer error message if it's because a symlink is
 		// linked to a directory that does not exist (probably because
@@ -109,7 +343,7 @@ func loadConfig() (*config, []string, error) {
 			}
 		}
 
-		str := "%s: Failed to create home directory: %v"
+		str := "%s: Failed to create data directory: %v"
 		err := fmt.Errorf(str, funcName, err)
 		fmt.Fprintln(os.Stderr, err)
 		return nil, nil, err
@@ -117,7 +351,9 @@ func loadConfig() (*config, []string, error) {
 
 	// Initialize log rotation.  After log rotation has been initialized, the
 	// logger variables may be used.
-	initLogRotator(defaultLogPath)
+	initLogRotator(filepath.Join(
+		defaultDataDir, "logs", "decred", cfg.network, defaultLogFilename,
+	))
 	setLogLevels(defaultLogLevel)
 
 	if cfg.UseLeHTTPS && cfg.Domain == "" {
@@ -126,6 +362,236 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
+	publicURL, err := defaultPublicURL(&cfg)
+	if err != nil {
+		err := fmt.Errorf("%s: invalid public_url: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	cfg.PublicURL = publicURL
+
+	if cfg.RateLimitBurst < 1 || cfg.RateLimitInterval <= 0 {
+		err := fmt.Errorf("%s: ratelimit_burst must be at least 1 and "+
+			"ratelimit_interval must be positive", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.GlobalLimitBurst < 0 ||
+		(cfg.GlobalLimitBurst > 0 && cfg.GlobalLimitInterval <= 0) {
+
+		err := fmt.Errorf("%s: globallimit_burst must not be negative "+
+			"and globallimit_interval must be positive", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.WithdrawLimitBurst < 1 || cfg.WithdrawLimitInterval <= 0 {
+		err := fmt.Errorf("%s: withdrawlimit_burst must be at least 1 "+
+			"and withdrawlimit_interval must be positive", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.MaxEventStreams < 1 {
+		err := fmt.Errorf("%s: max_event_streams must be at least 1",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.NodeInfoInterval <= 0 {
+		err := fmt.Errorf("%s: nodeinfo_interval must be positive",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		err := fmt.Errorf("%s: shutdown_timeout must be positive",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.LndRPCTimeout <= 0 || cfg.LndKeepalive <= 0 ||
+		cfg.LndMaxBackoff <= 0 || cfg.LndBreakerCooldown <= 0 {
+
+		err := fmt.Errorf("%s: lnd_rpc_timeout, lnd_keepalive, "+
+			"lnd_max_backoff and lnd_breaker_cooldown must be "+
+			"positive", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.LndBreakerFailures < 1 {
+		err := fmt.Errorf("%s: lnd_breaker_failures must be at least 1",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	cfg.minAmount, err = parseAmount(cfg.MinAmount, defaultAmountUnit)
+	if err != nil || cfg.minAmount < 1 {
+		err := fmt.Errorf("%s: min_amount must be at least one atom",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	cfg.maxAmount, err = parseAmount(cfg.MaxAmount, defaultAmountUnit)
+	if err != nil || cfg.maxAmount < cfg.minAmount {
+		err := fmt.Errorf("%s: max_amount must be a valid amount not "+
+			"below min_amount", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.InvoiceExpiry < minInvoiceExpiry ||
+		cfg.MaxInvoiceExpiry < cfg.InvoiceExpiry {
+
+		err := fmt.Errorf("%s: invoice_expiry must be at least %v and "+
+			"max_invoice_expiry not below invoice_expiry", funcName,
+			minInvoiceExpiry)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.InvoiceCltvExpiry != 0 &&
+		(cfg.InvoiceCltvExpiry < minCltvExpiry ||
+			cfg.InvoiceCltvExpiry > maxCltvExpiry) {
+
+		err := fmt.Errorf("%s: invoice_cltv_expiry must be between %d "+
+			"and %d", funcName, minCltvExpiry, maxCltvExpiry)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.LiquidityInterval <= 0 {
+		err := fmt.Errorf("%s: liquidity_interval must be positive",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	cfg.inboundAlertThreshold = cfg.maxAmount
+	if cfg.InboundAlertThreshold != "" {
+		cfg.inboundAlertThreshold, err = parseAmount(
+			cfg.InboundAlertThreshold, defaultAmountUnit,
+		)
+		if err != nil {
+			err := fmt.Errorf("%s: invalid inbound_alert_threshold: "+
+				"%v", funcName, err)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+	}
+
+	cfg.statsMemos, err = parseMemoVisibility(cfg.StatsMemos)
+	if err != nil {
+		err := fmt.Errorf("%s: invalid stats_memos: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.StatsLeaderboardSize < 0 {
+		err := fmt.Errorf("%s: stats_leaderboard_size must not be "+
+			"negative", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	switch cfg.FaucetMode {
+	case faucetModeTip, faucetModeOpenChannel:
+	default:
+		err := fmt.Errorf("%s: invalid faucet_mode %q, expected %s or %s",
+			funcName, cfg.FaucetMode, faucetModeTip,
+			faucetModeOpenChannel)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.FaucetMode == faucetModeOpenChannel && !cfg.AllowAdminMacaroon {
+		err := fmt.Errorf("%s: faucet_mode=openchannel requires "+
+			"allow_admin_macaroon, as opening channels needs a "+
+			"privileged macaroon", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.ReaperInterval < 0 || cfg.ChannelInactiveTimeout < 0 ||
+		cfg.ChannelForceCloseGrace < 0 {
+
+		err := fmt.Errorf("%s: reaper_interval, channel_inactive_timeout "+
+			"and channel_force_close_grace must not be negative",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.MaxChannels < 0 {
+		err := fmt.Errorf("%s: max_channels must not be negative",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.EnableWithdrawals && !cfg.AllowAdminMacaroon {
+		err := fmt.Errorf("%s: enable_withdrawals requires "+
+			"allow_admin_macaroon, as paying invoices needs a "+
+			"privileged macaroon", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	cfg.minWithdrawal, err = parseAmount(
+		cfg.MinWithdrawal, defaultAmountUnit,
+	)
+	if err != nil || cfg.minWithdrawal < 1 {
+		err := fmt.Errorf("%s: min_withdrawal must be at least one atom",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	cfg.maxWithdrawal, err = parseAmount(
+		cfg.MaxWithdrawal, defaultAmountUnit,
+	)
+	if err != nil || cfg.maxWithdrawal < cfg.minWithdrawal {
+		err := fmt.Errorf("%s: max_withdrawal must be a valid amount "+
+			"not below min_withdrawal", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.WithdrawalMaxFee < 0 || cfg.WithdrawalMaxFee > 100 {
+		err := fmt.Errorf("%s: withdrawal_max_fee must be a percentage "+
+			"between 0 and 100", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.AdminPasswordHash != "" {
+		_, err := bcrypt.Cost([]byte(cfg.AdminPasswordHash))
+		if err != nil {
+			err := fmt.Errorf("%s: admin_password_hash is not a "+
+				"valid bcrypt hash: %v", funcName, err)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+	}
+	if cfg.AdminTOTPSecret != "" {
+		cfg.adminTOTPSecret, err = parseTOTPSecret(cfg.AdminTOTPSecret)
+		if err != nil {
+			err := fmt.Errorf("%s: invalid admin_totp_secret: %v",
+				funcName, err)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+	}
+	if cfg.AdminSessionTimeout <= 0 {
+		err := fmt.Errorf("%s: admin_session_timeout must be positive",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
 	// Warn about missing config file only after all other configuration is
 	// done.  This prevents the warning on help messages and invalid
 	// options.  Note this should go directly before the return.
@@ -135,3 +601,33 @@ func loadConfig() (*config, []string, error) {
 
 	return &cfg, remainingArgs, nil
 }
+
+// defaultPublicURL returns the configured public URL without a trailing slash
+// or, when none is configured, the URL derived from the domain and bind
+// address.
+func defaultPublicURL(cfg *config) (string, error) {
+	if cfg.PublicURL == "" {
+		if cfg.UseLeHTTPS {
+			return "https://" + cfg.Domain, nil
+		}
+
+		_, port, err := net.SplitHostPort(cfg.BindAddr)
+		if err != nil {
+			return "", err
+		}
+		return "http://" + net.JoinHostPort("localhost", port), nil
+	}
+
+	u, err := url.Parse(cfg.PublicURL)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("must be an absolute http or https URL")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("must not contain a query or fragment")
+	}
+
+	return strings.TrimRight(cfg.PublicURL, "/"), nil
+}
@@ -3,15 +3,19 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"reflect"
+	"syscall"
 	"time"
 
 	"github.com/golang/crypto/acme/autocert"
+	"github.com/jessevdk/go-flags"
 
 	"github.com/gorilla/mux"
 )
@@ -37,42 +41,146 @@ var (
 	customFuncs = template.FuncMap{
 		"equal": equal,
 	}
-
-	// ctxb is a global context with no timeouts that's used within the
-	// gRPC requests to lnd.
-	ctxb = context.Background()
 )
 
 const (
 	staticDirName = "static"
+
+	// serverWriteTimeout is the time the HTTPS server allows to write a
+	// response.
+	serverWriteTimeout = 30 * time.Second
 )
 
 func main() {
+	if err := tippinMain(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// tippinMain is the true entry point of the faucet. It's separated from main
+// so deferred cleanup runs before the process exits with an error.
+func tippinMain() error {
 	// Load configuration and parse command line.  This function also
 	// initializes logging and configures it accordingly.
-	cfg, _, err := loadConfig()
+	cfg, args, err := loadConfig()
 	if err != nil {
-		return
+		// The help message isn't an error.
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		if logRotator != nil {
+			logRotator.Close()
+		}
+	}()
+
+	// Handle the commands which don't run the faucet.
+	if len(args) > 0 {
+		return runCommand(cfg, args)
 	}
 
 	// Pre-compile the list of templates so we'll catch any errors in the
 	// templates as soon as the binary is run.
-	faucetTemplates := template.Must(template.New("faucet").
+	faucetTemplates, err := template.New("faucet").
 		Funcs(customFuncs).
-		ParseGlob(templateGlobPattern))
+		ParseGlob(templateGlobPattern)
+	if err != nil {
+		log.Criticalf("unable to parse templates: %v", err)
+		return err
+	}
+
+	limiter, err := newRateLimiter(cfg.RateLimitBurst,
+		cfg.RateLimitInterval, cfg.GlobalLimitBurst,
+		cfg.GlobalLimitInterval, cfg.TrustedProxies)
+	if err != nil {
+		log.Criticalf("unable to create rate limiter: %v", err)
+		return err
+	}
+
+	// Withdrawals are limited separately, so checking a balance doesn't
+	// use up the invoices of a client, nor the other way around.
+	withdrawLimiter, err := newRateLimiter(cfg.WithdrawLimitBurst,
+		cfg.WithdrawLimitInterval, 0, 0, cfg.TrustedProxies)
+	if err != nil {
+		log.Criticalf("unable to create rate limiter: %v", err)
+		return err
+	}
+
+	// Logins are limited at a fixed rate, so raising the rate limit of
+	// the invoices doesn't make guessing the password any easier.
+	loginLimiter, err := newRateLimiter(adminLoginBurst,
+		adminLoginInterval, 0, 0, cfg.TrustedProxies)
+	if err != nil {
+		log.Criticalf("unable to create rate limiter: %v", err)
+		return err
+	}
+
+	// All requests to dcrlnd are made within the root context, so
+	// canceling it on shutdown aborts the ones still in flight.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	faucet, err := newLightningClient(cfg.LndNode, tlsCertPath, defaultMacaroonPath, faucetTemplates)
+	faucet, err := newLightningClient(
+		ctx, cfg, limiter, withdrawLimiter, loginLimiter,
+		faucetTemplates,
+	)
 	if err != nil {
 		log.Criticalf("unable to create faucet: %v", err)
-		os.Exit(1)
-		return
+		return err
 	}
+	faucet.Start()
+	defer faucet.Stop()
 
 	// Create a new mux in order to route a request based on its path to a
 	// dedicated http.Handler.
 	r := mux.NewRouter()
 	r.HandleFunc("/", faucet.faucetHome).Methods("POST", "GET")
 	r.HandleFunc("/button", faucet.renderButton).Methods("POST", "GET")
+	r.HandleFunc("/invoice/{rhash}", faucet.invoicePage).Methods("GET")
+	r.HandleFunc("/invoice/{rhash}/qr.{format:png|svg}", faucet.invoiceQRCode).Methods("GET")
+	r.HandleFunc("/invoice/{rhash}/events", faucet.invoiceEvents).Methods("GET")
+	r.HandleFunc("/api/invoice/{rhash}", faucet.apiInvoiceStatus).Methods("GET")
+	r.HandleFunc("/stats", faucet.statsPage).Methods("GET")
+
+	// Register the pages of the hosted recipients.
+	r.HandleFunc("/u/{slug}", faucet.recipientHome).Methods("POST", "GET")
+	r.HandleFunc("/u/{slug}/button", faucet.recipientButton).Methods("GET")
+	r.HandleFunc("/u/{slug}/invoice/{rhash}", faucet.recipientInvoicePage).Methods("GET")
+	r.HandleFunc("/u/{slug}/withdraw", faucet.recipientWithdraw).Methods("POST", "GET")
+
+	// Register the embeddable widgets.
+	r.HandleFunc("/embed/{widgetID}", faucet.renderEmbed).Methods("POST", "GET")
+	r.HandleFunc("/embed/{widgetID}/widget.js", faucet.widgetScript).Methods("GET")
+	r.HandleFunc("/embed/{widgetID}/invoice/{rhash}", faucet.embedInvoicePage).Methods("GET")
+
+	// Register the admin dashboard.
+	r.HandleFunc(adminPath, faucet.adminHome).Methods("GET")
+	r.HandleFunc(adminLoginPath, faucet.adminLogin).Methods("POST", "GET")
+	r.HandleFunc(adminPath+"/logout", faucet.adminLogout).Methods("POST")
+	r.HandleFunc(adminPath+"/settings", faucet.adminUpdateSettings).Methods("POST")
+	r.HandleFunc(adminPath+"/invoices/{rhash}/cancel", faucet.adminCancelInvoice).Methods("POST")
+	r.HandleFunc(adminPath+"/invoices/{rhash}/hide", faucet.adminHideInvoice).Methods("POST")
+	r.HandleFunc(adminPath+"/webhooks/{endpoint}/{id}/retry", faucet.adminRetryWebhook).Methods("POST")
+	r.HandleFunc(adminPath+"/withdrawals/{rhash}/release", faucet.adminReleaseWithdrawal).Methods("POST")
+
+	// Register the versioned JSON API.
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	api.HandleFunc("/invoices", faucet.apiCreateInvoice).Methods("POST")
+	api.HandleFunc("/invoices/{rhash}", faucet.apiInvoiceStatus).Methods("GET")
+	api.HandleFunc("/node", faucet.apiNodeInfo).Methods("GET")
+	api.HandleFunc("/channels", faucet.apiOpenChannel).Methods("POST")
+	api.HandleFunc("/stats", faucet.apiStats).Methods("GET")
+	api.HandleFunc("/recipients/{slug}/balance", faucet.apiRecipientBalance).Methods("GET")
+	api.HandleFunc("/recipients/{slug}/withdrawals", faucet.apiWithdraw).Methods("POST")
+
+	// Register the monitoring endpoints and record the duration of every
+	// request.
+	r.HandleFunc("/healthz", faucet.healthz).Methods("GET")
+	r.HandleFunc("/readyz", faucet.readyz).Methods("GET")
+	r.HandleFunc("/metrics", faucet.metrics).Methods("GET")
+	r.Use(instrumentHandler)
 
 	// Next create a static file server which will dispatch our static
 	// files. We rap the file sever http.Handler is a handler that strips
@@ -86,9 +194,14 @@ func main() {
 	// the global http handler.
 	http.Handle("/", r)
 
+	var servers []*httpServer
 	if !cfg.UseLeHTTPS {
-		log.Infof("Listening on %s", cfg.BindAddr)
-		go http.ListenAndServe(cfg.BindAddr, r)
+		servers = append(servers, &httpServer{
+			Server: &http.Server{
+				Addr:    cfg.BindAddr,
+				Handler: r,
+			},
+		})
 	} else {
 		// Create a directory cache so the certs we get from Let's
 		// Encrypt are cached locally. This avoids running into their
@@ -105,37 +218,168 @@ func main() {
 
 		// As we'd like all requests to default to https, redirect all regular
 		// http requests to the https version of the faucet.
-		log.Infof("Listening on %s", cfg.BindAddr)
-		go http.ListenAndServe(cfg.BindAddr, m.HTTPHandler(nil))
+		servers = append(servers, &httpServer{
+			Server: &http.Server{
+				Addr:    cfg.BindAddr,
+				Handler: m.HTTPHandler(nil),
+			},
+		})
 
 		// Finally, create the http server, passing in our TLS configuration.
-		httpServer := &http.Server{
-			Handler:      r,
-			WriteTimeout: 30 * time.Second,
-			ReadTimeout:  30 * time.Second,
-			Addr:         ":https",
-			TLSConfig: &tls.Config{
-				GetCertificate: m.GetCertificate,
-				MinVersion:     tls.VersionTLS12,
-				CipherSuites: []uint16{
-					tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-					tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-					tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-					tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		servers = append(servers, &httpServer{
+			Server: &http.Server{
+				Handler:      r,
+				WriteTimeout: serverWriteTimeout,
+				ReadTimeout:  30 * time.Second,
+				Addr:         ":https",
+				TLSConfig: &tls.Config{
+					GetCertificate: m.GetCertificate,
+					MinVersion:     tls.VersionTLS12,
+					CipherSuites: []uint16{
+						tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+						tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+						tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+						tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+						tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+						tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+					},
 				},
 			},
+			useTLS: true,
+		})
+	}
+
+	// Bind all the listeners before serving any request, so a failure to
+	// bind is reported right away.
+	for i, srv := range servers {
+		if err := srv.listen(); err != nil {
+			log.Criticalf("unable to listen on %s: %v", srv.Addr, err)
+			for _, bound := range servers[:i] {
+				bound.listener.Close()
+			}
+			return err
 		}
-		if err := httpServer.ListenAndServeTLS("", ""); err != nil {
-			log.Critical(err)
-			os.Exit(1)
+	}
+
+	serveErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		// The invoice status streams never complete on their own, so
+		// they're ended as soon as the shutdown starts.
+		srv.RegisterOnShutdown(faucet.eventStreams.Close)
+
+		log.Infof("Listening on %s", srv.listener.Addr())
+		go func(srv *httpServer) {
+			serveErr <- srv.serve()
+		}(srv)
+	}
+
+	// Wait until we're asked to shut down or one of the servers fails.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	var runErr error
+	select {
+	case sig := <-interrupt:
+		log.Infof("Received %v, shutting down", sig)
+	case runErr = <-serveErr:
+		log.Criticalf("HTTP server failed: %v", runErr)
+	}
+	signal.Stop(interrupt)
+
+	// Stop accepting new requests and give the ones in flight some time
+	// to complete. Whatever is still running afterwards is aborted when
+	// the faucet stops.
+	shutdownCtx, shutdownCancel := context.WithTimeout(
+		context.Background(), cfg.ShutdownTimeout,
+	)
+	defer shutdownCancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Warnf("Unable to gracefully shut down server on "+
+				"%s: %v", srv.Addr, err)
 		}
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
+	log.Infof("Shutdown complete")
+	return runErr
+}
+
+// httpServer is an http.Server bound to its listener ahead of serving.
+type httpServer struct {
+	*http.Server
+
+	// useTLS indicates whether the connections are served over TLS using
+	// the TLSConfig of the server.
+	useTLS bool
+
+	listener net.Listener
+}
+
+// listen binds the listener of the server.
+func (s *httpServer) listen() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	return nil
+}
+
+// serve accepts connections on the bound listener until the server is shut
+// down, which isn't considered an error.
+func (s *httpServer) serve() error {
+	var err error
+	if s.useTLS {
+		err = s.ServeTLS(s.listener, "", "")
+	} else {
+		err = s.Serve(s.listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// runCommand executes the command given in args.
+func runCommand(cfg *config, args []string) error {
+	switch args[0] {
+	case "bakemacaroon":
+		outPath := filepath.Join(cfg.dataDir, bakedMacaroonFilename)
+		if len(args) > 1 {
+			outPath = cleanAndExpandPath(args[1])
+		}
+
+		if err := bakeMacaroon(cfg, outPath); err != nil {
+			log.Criticalf("unable to bake macaroon: %v", err)
+			return err
+		}
+
+		log.Infof("Macaroon limited to the needs of the faucet saved to "+
+			"%s, use it by setting --macaroonpath=%s", outPath, outPath)
+		return nil
+
+	case "hashpassword":
+		hash, err := hashPassword(os.Stdin)
+		if err != nil {
+			log.Criticalf("unable to hash password: %v", err)
+			return err
+		}
+
+		fmt.Println(string(hash))
+		return nil
+
+	default:
+		err := fmt.Errorf("unknown command %q", args[0])
+		log.Critical(err)
+		return err
+	}
 }
 
 func init() {
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sseMaxDuration is how long a Server-Sent Events stream is kept
+	// open. It must end before the write timeout of the server cuts it,
+	// after which browsers reconnect on their own.
+	sseMaxDuration = serverWriteTimeout - 5*time.Second
+
+	// sseRetry is the time browsers wait before reconnecting a
+	// Server-Sent Events stream.
+	sseRetry = 3 * time.Second
+
+	// eventKeepAliveInterval is the interval at which idle streams are
+	// written to, so intermediaries don't close them.
+	eventKeepAliveInterval = 15 * time.Second
+
+	// wsWriteTimeout is the deadline of each write to a WebSocket
+	// connection.
+	wsWriteTimeout = 10 * time.Second
+
+	// wsMaxMessageSize is the largest message accepted from WebSocket
+	// clients, which aren't expected to send anything.
+	wsMaxMessageSize = 512
+)
+
+var (
+	// errTooManyStreams is returned when a client already has as many
+	// streams open as allowed.
+	errTooManyStreams = errors.New("too many streams")
+
+	// errStreamsClosed is returned when opening a stream while the faucet
+	// shuts down.
+	errStreamsClosed = errors.New("streams closed")
+
+	// wsUpgrader upgrades the requests to the invoice events to WebSocket
+	// connections. Only pages served by the faucet may connect, which is
+	// the default check of the origin.
+	wsUpgrader = websocket.Upgrader{
+		ReadBufferSize:  wsMaxMessageSize,
+		WriteBufferSize: 1024,
+	}
+)
+
+// eventStreams tracks the open invoice status streams, limiting the number
+// each client may keep open.
+type eventStreams struct {
+	maxPerClient int
+
+	mtx     sync.Mutex
+	clients map[string]int
+	cancels map[uint64]context.CancelFunc
+	nextID  uint64
+	closed  bool
+}
+
+// newEventStreams creates a tracker allowing each client to keep up to
+// maxPerClient streams open.
+func newEventStreams(maxPerClient int) *eventStreams {
+	return &eventStreams{
+		maxPerClient: maxPerClient,
+		clients:      make(map[string]int),
+		cancels:      make(map[uint64]context.CancelFunc),
+	}
+}
+
+// open registers a stream of the client. The returned context is canceled
+// when the streams are closed, and the returned function must be called once
+// the stream ends.
+func (s *eventStreams) open(ctx context.Context,
+	client string) (context.Context, func(), error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch {
+	case s.closed:
+		return nil, nil, errStreamsClosed
+	case s.clients[client] >= s.maxPerClient:
+		return nil, nil, errTooManyStreams
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	id := s.nextID
+	s.nextID++
+	s.clients[client]++
+	s.cancels[id] = cancel
+
+	release := func() {
+		cancel()
+
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		delete(s.cancels, id)
+		s.clients[client]--
+		if s.clients[client] == 0 {
+			delete(s.clients, client)
+		}
+	}
+
+	return ctx, release, nil
+}
+
+// Close ends the open streams and refuses new ones.
+func (s *eventStreams) Close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.closed = true
+	for _, cancel := range s.cancels {
+		cancel()
+	}
+}
+
+// invoiceEvents streams the status of the invoice identified by the payment
+// hash in the URL until it's settled, expired or canceled. The stream uses
+// Server-Sent Events, or a WebSocket connection when the request is an
+// upgrade. Each update is the same JSON object returned by the invoice
+// status API.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) invoiceEvents(w http.ResponseWriter, r *http.Request) {
+	rHash, ok := apiPaymentHash(w, r)
+	if !ok {
+		return
+	}
+
+	if _, ok := l.visibleTip(rHash); !ok {
+		writeAPIError(w, http.StatusNotFound, "invoice_not_found",
+			"invoice not found")
+		return
+	}
+
+	client := l.limiter.clientIP(r)
+	ctx, release, err := l.eventStreams.open(r.Context(), clientKey(client))
+	switch {
+	case err == errTooManyStreams:
+		log.Debugf("Rejected invoice stream from %s: %v", client, err)
+		writeAPIError(w, http.StatusTooManyRequests, "too_many_streams",
+			fmt.Sprintf("at most %d invoice streams may be open at "+
+				"once", l.eventStreams.maxPerClient))
+		return
+
+	case err != nil:
+		writeAPIError(w, http.StatusServiceUnavailable, "shutting_down",
+			"the faucet is shutting down")
+		return
+	}
+	defer release()
+
+	// The invoice is watched before it's looked up, so no update is
+	// missed in between.
+	updates, stopWatching := l.invoices.watch(rHash)
+	defer stopWatching()
+
+	invoice, err := l.invoices.lookup(l.ctx, rHash)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "invoice_not_found",
+			"invoice not found")
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		l.streamInvoiceWebSocket(ctx, w, r, invoice, updates)
+		return
+	}
+	l.streamInvoiceSSE(ctx, w, invoice, updates)
+}
+
+// streamInvoiceSSE streams the status of the invoice as Server-Sent Events.
+func (l *lightningFaucet) streamInvoiceSSE(ctx context.Context,
+	w http.ResponseWriter, invoice *trackedInvoice,
+	updates <-chan struct{}) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError,
+			"streaming_unsupported", "streaming is not supported")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sseMaxDuration)
+	defer cancel()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+
+	// Reverse proxies such as nginx buffer responses by default, which
+	// would hold the events back.
+	h.Set("X-Accel-Buffering", "no")
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry/time.Millisecond)
+	flusher.Flush()
+
+	send := func(status *invoiceStatusResponse) error {
+		statusBytes, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n",
+			statusBytes)
+		flusher.Flush()
+		return err
+	}
+	keepAlive := func() error {
+		_, err := fmt.Fprint(w, ": keepalive\n\n")
+		flusher.Flush()
+		return err
+	}
+
+	eventStreamsOpened.inc("sse")
+	l.streamInvoice(ctx, invoice, updates, send, keepAlive)
+}
+
+// streamInvoiceWebSocket upgrades the request to a WebSocket connection and
+// streams the status of the invoice as JSON messages.
+func (l *lightningFaucet) streamInvoiceWebSocket(ctx context.Context,
+	w http.ResponseWriter, r *http.Request, invoice *trackedInvoice,
+	updates <-chan struct{}) {
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied with an error.
+		log.Debugf("Unable to upgrade invoice stream: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// The connection must be read to process the control messages of the
+	// client, and a failed read means it went away.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn.SetReadLimit(wsMaxMessageSize)
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(status *invoiceStatusResponse) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteJSON(status)
+	}
+	keepAlive := func() error {
+		return conn.WriteControl(
+			websocket.PingMessage, nil,
+			time.Now().Add(wsWriteTimeout),
+		)
+	}
+
+	eventStreamsOpened.inc("websocket")
+	l.streamInvoice(ctx, invoice, updates, send, keepAlive)
+
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(wsWriteTimeout),
+	)
+}
+
+// streamInvoice sends the status of the invoice, then again whenever it
+// changes until it's no longer open or ctx is canceled. keepAlive is called
+// whenever the stream was idle for a while.
+func (l *lightningFaucet) streamInvoice(ctx context.Context,
+	invoice *trackedInvoice, updates <-chan struct{},
+	send func(*invoiceStatusResponse) error, keepAlive func() error) {
+
+	status := newInvoiceStatusResponse(invoice)
+	if err := send(status); err != nil {
+		return
+	}
+
+	// The expiry of an invoice isn't notified by dcrlnd, so the stream
+	// wakes up once it's due.
+	expiry := time.NewTimer(time.Until(invoice.expiresAt()) + time.Second)
+	defer expiry.Stop()
+
+	ticker := time.NewTicker(eventKeepAliveInterval)
+	defer ticker.Stop()
+
+	for status.Status == invoiceStatusOpen {
+		select {
+		case <-updates:
+			updated, err := l.invoices.lookup(l.ctx, invoice.RHash)
+			if err != nil {
+				return
+			}
+			invoice = updated
+
+		case <-expiry.C:
+
+		case <-ticker.C:
+			if err := keepAlive(); err != nil {
+				return
+			}
+			continue
+
+		case <-ctx.Done():
+			return
+		}
+
+		// Updates are also signaled when the invoice is looked up, so
+		// they don't always change its status.
+		updated := newInvoiceStatusResponse(invoice)
+		if updated.Status == status.Status {
+			continue
+		}
+
+		status = updated
+		if err := send(status); err != nil {
+			return
+		}
+	}
+}
@@ -1,25 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	macaroon "gopkg.in/macaroon.v2"
-
 	"github.com/decred/dcrd/dcrutil"
 	"github.com/decred/dcrlnd/lnrpc"
-	"github.com/decred/dcrlnd/macaroons"
-
+	"github.com/decred/dcrlnd/lnrpc/invoicesrpc"
+	"github.com/gorilla/mux"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 )
 
 const (
@@ -89,21 +87,115 @@ const (
 	// InvoiceAmountTooHigh indicates the user tried to generate an invoice
 	// that was too expensive.
 	InvoiceAmountTooHigh
-)
 
-var (
+	// NodeNotSynced indicates the node is still catching up with the
+	// chain, so invoices can't be generated yet.
+	NodeNotSynced
+
+	// InvoiceAmountTooLow indicates the user tried to generate an invoice
+	// below the minimum amount.
+	InvoiceAmountTooLow
+
+	// InvoiceAmountNegative indicates the user tried to generate an
+	// invoice with a negative amount.
+	InvoiceAmountNegative
+
+	// InvoiceAmountTooPrecise indicates the amount of the invoice isn't a
+	// whole number of atoms.
+	InvoiceAmountTooPrecise
+
+	// NodeUnavailable indicates the node can't currently be reached.
+	NodeUnavailable
+
+	// InvalidNickname indicates the nickname for the leaderboard is too
+	// long or contains unprintable characters.
+	InvalidNickname
+
+	// UnknownRecipient indicates the invoice was requested for a recipient
+	// which isn't registered.
+	UnknownRecipient
+
+	// TooManyAttempts indicates the client made too many withdrawal
+	// attempts in a short time.
+	TooManyAttempts
+
+	// InvalidPayoutToken indicates the token given to withdraw the balance
+	// of a recipient is wrong.
+	InvalidPayoutToken
+
+	// InvalidPaymentRequest indicates the invoice submitted for a
+	// withdrawal couldn't be decoded or can't be paid by the node.
+	InvalidPaymentRequest
+
+	// PaymentRequestNoAmount indicates the invoice submitted for a
+	// withdrawal doesn't specify an amount.
+	PaymentRequestNoAmount
+
+	// PaymentRequestExpired indicates the invoice submitted for a
+	// withdrawal has expired.
+	PaymentRequestExpired
+
+	// WithdrawalAmountTooLow indicates the amount of the withdrawal is
+	// below the minimum.
+	WithdrawalAmountTooLow
+
+	// WithdrawalAmountTooHigh indicates the amount of the withdrawal is
+	// above the maximum.
+	WithdrawalAmountTooHigh
+
+	// InsufficientBalance indicates the balance of the recipient doesn't
+	// cover the amount of the withdrawal plus its maximum fee.
+	InsufficientBalance
+
+	// WithdrawalFailed indicates the withdrawal couldn't be started.
+	WithdrawalFailed
+
+	// InvalidCredentials indicates the password or one-time password
+	// given to log into the admin dashboard is wrong.
+	InvalidCredentials
 
-	// GenerateInvoiceTimeout represents the minimum time to generate a new
-	// invoice in seconds.
-	GenerateInvoiceTimeout = time.Duration(60) * time.Second
+	// InvalidAmountLimits indicates the amount limits submitted through
+	// the admin dashboard aren't valid amounts or the minimum exceeds the
+	// maximum.
+	InvalidAmountLimits
 
+	// InvalidRateLimit indicates the rate limit submitted through the
+	// admin dashboard isn't valid.
+	InvalidRateLimit
+
+	// CancelInvoiceFailed indicates the node refused to cancel an
+	// invoice.
+	CancelInvoiceFailed
+
+	// InsufficientInboundCapacity indicates the node doesn't have the
+	// inbound capacity to receive the amount of the invoice.
+	InsufficientInboundCapacity
+
+	// InvalidInvoiceExpiry indicates the requested expiry of the invoice
+	// is too short or too long.
+	InvalidInvoiceExpiry
+
+	// InvalidCltvExpiry indicates the requested CLTV delta of the final
+	// hop of the invoice is out of range.
+	InvalidCltvExpiry
+
+	// OpenAmountDisabled indicates an invoice of any amount was requested
+	// while the faucet doesn't allow them.
+	OpenAmountDisabled
+
+	// WithdrawalNotReleased indicates the operator tried to release a
+	// withdrawal whose payment may still be in flight.
+	WithdrawalNotReleased
+)
+
+var (
 	// GenerateInvoiceAction represents an action to generate invoice on post forms
 	GenerateInvoiceAction = "generateinvoice"
-)
 
-// lastGeneratedInvoiceTime stores the last time an invoice generation was
-// attempted.
-var lastGeneratedInvoiceTime time.Time
+	// OpenChannelAction represents an action to open a channel on post
+	// forms.
+	OpenChannelAction = "openchannel"
+)
 
 // String returns a human readable string describing the chanCreationError.
 // This string is used in the templates in order to display the error to the
@@ -121,7 +213,8 @@ func (c chanCreationError) String() string {
 	case ChannelTooLarge:
 		return "Amount is too large"
 	case ChannelTooSmall:
-		return fmt.Sprintf("Minimum channel size is is %d DCR", minChannelSize)
+		return fmt.Sprintf("Minimum channel size is %s DCR",
+			formatAmount(dcrutil.Amount(minChannelSize)))
 	case PushIncorrect:
 		return "Initial Balance is incorrect"
 	case ChannelOpenFail:
@@ -136,77 +229,533 @@ func (c chanCreationError) String() string {
 		return "Please wait until you can generate a new invoice"
 	case InvoiceAmountTooHigh:
 		return "Invoice amount too high"
+	case NodeNotSynced:
+		return "The node is not synced yet, please try again later"
+	case InvoiceAmountTooLow:
+		return "Invoice amount too low"
+	case InvoiceAmountNegative:
+		return "Invoice amount must not be negative"
+	case InvoiceAmountTooPrecise:
+		return "Invoice amount must be a whole number of atoms"
+	case NodeUnavailable:
+		return "The node is unavailable, please try again later"
+	case InvalidNickname:
+		return fmt.Sprintf("Nickname must be at most %d printable "+
+			"characters", maxNicknameLength)
+	case UnknownRecipient:
+		return "Unknown recipient"
+	case TooManyAttempts:
+		return "Too many attempts, please try again later"
+	case InvalidPayoutToken:
+		return "Invalid payout token"
+	case InvalidPaymentRequest:
+		return "Not a valid payment request"
+	case PaymentRequestNoAmount:
+		return "Payment request must specify an amount"
+	case PaymentRequestExpired:
+		return "Payment request has expired"
+	case WithdrawalAmountTooLow:
+		return "Withdrawal amount too low"
+	case WithdrawalAmountTooHigh:
+		return "Withdrawal amount too high"
+	case InsufficientBalance:
+		return "Balance too low to cover the amount and the fees"
+	case WithdrawalFailed:
+		return "Error starting the withdrawal"
+	case InvalidCredentials:
+		return "Invalid credentials"
+	case InvalidAmountLimits:
+		return "Amounts must be at least one atom, with the minimum " +
+			"not above the maximum"
+	case InvalidRateLimit:
+		return "Burst must be at least 1 and the interval a positive " +
+			"duration such as 1m"
+	case CancelInvoiceFailed:
+		return "Unable to cancel the invoice"
+	case InsufficientInboundCapacity:
+		return "The node can't receive this amount at the moment"
+	case InvalidInvoiceExpiry:
+		return fmt.Sprintf("Invoice expiry must be at least %v and "+
+			"at most the maximum allowed by the faucet",
+			minInvoiceExpiry)
+	case InvalidCltvExpiry:
+		return fmt.Sprintf("CLTV expiry must be between %d and %d "+
+			"blocks", minCltvExpiry, maxCltvExpiry)
+	case OpenAmountDisabled:
+		return "Tips of any amount are disabled, please enter an amount"
+	case WithdrawalNotReleased:
+		return "Unable to release the withdrawal, its payment may " +
+			"still be in flight"
 	default:
 		return fmt.Sprintf("%v", uint8(c))
 	}
 }
 
-// lightningFaucet is a Decred Channel Faucet. The faucet itself is a web app
-// that is capable of programmatically opening channels with users with the
-// size of the channel parametrized by the user. The faucet required a
-// connection to a local lnd node in order to operate properly. The faucet
-// implements the constrains on the channel size, and also will only open a
-// single channel to a particular node. Finally, the faucet will periodically
-// close channels based on their age as the faucet will only open up 100
-// channels total at any given time.
+// Code returns a stable machine readable identifier for the
+// chanCreationError. This is used by the JSON API so clients don't need to
+// depend on either the numeric value or the human readable message.
+func (c chanCreationError) Code() string {
+	switch c {
+	case NoError:
+		return ""
+	case InvalidAddress:
+		return "invalid_address"
+	case NotConnected:
+		return "not_connected"
+	case ChanAmountNotNumber:
+		return "amount_not_number"
+	case ChannelTooLarge:
+		return "channel_too_large"
+	case ChannelTooSmall:
+		return "channel_too_small"
+	case PushIncorrect:
+		return "push_incorrect"
+	case ChannelOpenFail:
+		return "channel_open_fail"
+	case HaveChannel:
+		return "have_channel"
+	case HavePendingChannel:
+		return "have_pending_channel"
+	case ErrorGeneratingInvoice:
+		return "error_generating_invoice"
+	case InvoiceTimeNotElapsed:
+		return "invoice_time_not_elapsed"
+	case InvoiceAmountTooHigh:
+		return "invoice_amount_too_high"
+	case NodeNotSynced:
+		return "node_not_synced"
+	case InvoiceAmountTooLow:
+		return "invoice_amount_too_low"
+	case InvoiceAmountNegative:
+		return "invoice_amount_negative"
+	case InvoiceAmountTooPrecise:
+		return "invoice_amount_too_precise"
+	case NodeUnavailable:
+		return "node_unavailable"
+	case InvalidNickname:
+		return "invalid_nickname"
+	case UnknownRecipient:
+		return "unknown_recipient"
+	case TooManyAttempts:
+		return "too_many_attempts"
+	case InvalidPayoutToken:
+		return "invalid_payout_token"
+	case InvalidPaymentRequest:
+		return "invalid_payment_request"
+	case PaymentRequestNoAmount:
+		return "payment_request_no_amount"
+	case PaymentRequestExpired:
+		return "payment_request_expired"
+	case WithdrawalAmountTooLow:
+		return "withdrawal_amount_too_low"
+	case WithdrawalAmountTooHigh:
+		return "withdrawal_amount_too_high"
+	case InsufficientBalance:
+		return "insufficient_balance"
+	case WithdrawalFailed:
+		return "withdrawal_failed"
+	case InvalidCredentials:
+		return "invalid_credentials"
+	case InvalidAmountLimits:
+		return "invalid_amount_limits"
+	case InvalidRateLimit:
+		return "invalid_rate_limit"
+	case CancelInvoiceFailed:
+		return "cancel_invoice_failed"
+	case InsufficientInboundCapacity:
+		return "insufficient_inbound_capacity"
+	case InvalidInvoiceExpiry:
+		return "invalid_invoice_expiry"
+	case InvalidCltvExpiry:
+		return "invalid_cltv_expiry"
+	case OpenAmountDisabled:
+		return "open_amount_disabled"
+	case WithdrawalNotReleased:
+		return "withdrawal_not_released"
+	default:
+		return fmt.Sprintf("error_%d", uint8(c))
+	}
+}
+
+// lightningFaucet is a Decred tip jar. The faucet itself is a web app that
+// generates invoices for visitors to tip the node, and when running in the
+// openchannel mode, is also capable of programmatically opening channels with
+// users with the size of the channel parametrized by the user. The faucet
+// required a connection to a local lnd node in order to operate properly. The
+// faucet implements the constrains on the channel size, and also will only
+// open a single channel to a particular node. Finally, the faucet will
+// periodically close channels based on their age as the faucet will only keep
+// a limited number of channels open at any given time, 100 by default.
 type lightningFaucet struct {
 	lnd lnrpc.LightningClient
 
-	templates       *template.Template
-	homePageContext *homePageContext
+	// invoicesClient is used to cancel invoices.
+	invoicesClient invoicesrpc.InvoicesClient
+
+	// conn is the connection to dcrlnd, closed when the faucet stops.
+	conn *grpc.ClientConn
+
+	// ctx is canceled when the faucet stops, aborting any requests to
+	// dcrlnd still in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	templates *template.Template
+
+	// invoices tracks the settlement of the invoices created by the
+	// faucet.
+	invoices *invoiceTracker
+
+	// webhooks notifies the configured endpoints of the settled tips.
+	webhooks *webhookDispatcher
+
+	// eventStreams limits the invoice status streams of each client.
+	eventStreams *eventStreams
+
+	// nodeInfo keeps the identity and sync state of the node up to date.
+	nodeInfo *nodeInfoMonitor
+
+	// liquidity tracks how much the node can receive, nil when the
+	// macaroon doesn't allow listing the channels.
+	liquidity *liquidityMonitor
+
+	// reaper closes the channels opened to visitors, nil unless channels
+	// are opened and closed by the faucet.
+	reaper *channelReaper
 
-	openChanMtx sync.RWMutex
+	// withdrawals records the outcome of the withdrawals left pending,
+	// nil unless withdrawals are enabled.
+	withdrawals *withdrawalReconciler
+
+	// breaker tracks whether the node can be reached.
+	breaker *circuitBreaker
+
+	// store records the tips requested through the faucet.
+	store *tipStore
+
+	// stats serves the public statistics of the tips.
+	stats *statsCache
+
+	// limiter limits the rate at which each client may generate
+	// invoices.
+	limiter *rateLimiter
+
+	// withdrawLimiter limits the rate at which each client may check the
+	// balance of a recipient or withdraw it, so payout tokens can't be
+	// guessed.
+	withdrawLimiter *rateLimiter
+
+	// loginLimiter limits the rate at which each client may attempt to
+	// log into the admin dashboard.
+	loginLimiter *rateLimiter
+
+	// publicURL is the base URL under which the faucet is reachable by
+	// visitors, used to build absolute links.
+	publicURL string
+
+	// widgets are the embeddable widgets indexed by their ID.
+	widgets map[string]*widget
+
+	// recipients are the hosted recipients indexed by their slug.
+	recipients map[string]*recipient
+
+	// admin authenticates the operator on the admin dashboard, nil when
+	// the dashboard is disabled.
+	admin *adminAuth
+
+	// minAmount and maxAmount are the limits of the amount of the
+	// invoices. They may be changed through the admin dashboard, so they
+	// must only be accessed through amountLimits and setAmountLimits.
+	amountsMtx sync.RWMutex
+	minAmount  dcrutil.Amount
+	maxAmount  dcrutil.Amount
+
+	// withdrawalsEnabled indicates recipients may withdraw their balance.
+	// The amount of a withdrawal must be within minWithdrawal and
+	// maxWithdrawal, and at most withdrawalMaxFee percent of it may be
+	// spent on fees.
+	withdrawalsEnabled bool
+	minWithdrawal      dcrutil.Amount
+	maxWithdrawal      dcrutil.Amount
+	withdrawalMaxFee   int64
+
+	// invoiceOpts are the default options of the invoices.
+	invoiceOpts invoiceOptions
+
+	// openAmounts indicates tippers may request invoices without an
+	// amount, paying whatever they choose within the amount limits.
+	openAmounts bool
+
+	// openChannels indicates visitors may ask the faucet to open a channel
+	// to their node. openChanMtx serializes the channel openings, so only a
+	// single channel is opened to each node.
+	openChannels bool
+	openChanMtx  sync.RWMutex
 }
 
-// newLightningClient creates a new channel faucet that's bound to a cluster of
-// lnd nodes, and uses the passed templates to render the web page.
-func newLightningClient(
-	lndNode, tlsCertPath, macaroonPath string, templates *template.Template) (
-	*lightningFaucet, error) {
+// newLightningClient creates a new channel faucet that's bound to the lnd
+// node described by cfg, and uses the passed templates to render the web
+// page. Invoice requests are throttled by limiter, withdrawals by
+// withdrawLimiter and admin logins by loginLimiter. Requests to dcrlnd are
+// made within ctx.
+func newLightningClient(ctx context.Context, cfg *config, limiter,
+	withdrawLimiter, loginLimiter *rateLimiter,
+	templates *template.Template) (*lightningFaucet, error) {
+
+	// Load the specified macaroon file, making sure it doesn't grant
+	// more privileges than the faucet should have.
+	mac, err := loadMacaroon(cfg.MacaroonPath)
+	if err != nil {
+		return nil, err
+	}
+	err = checkMacaroonPermissions(mac, cfg.AllowAdminMacaroon)
+	if err != nil {
+		return nil, fmt.Errorf("refusing to use %s: %v",
+			cfg.MacaroonPath, err)
+	}
+	if cfg.AllowAdminMacaroon {
+		log.Warnf("Privileged macaroons are allowed, a compromised " +
+			"faucet may be able to move the funds of the node")
+	}
+	if cfg.EnableWithdrawals {
+		err := checkWithdrawalPermissions(mac)
+		if err != nil {
+			return nil, fmt.Errorf("unable to enable withdrawals "+
+				"with %s: %v", cfg.MacaroonPath, err)
+		}
+	}
+	if cfg.FaucetMode == faucetModeOpenChannel {
+		err := checkChannelPermissions(mac)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open channels with "+
+				"%s: %v", cfg.MacaroonPath, err)
+		}
+	}
+
+	widgets, err := loadWidgets(
+		cfg.WidgetsFile, cfg.minAmount, cfg.maxAmount,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load widgets: %v", err)
+	}
 
-	// First attempt to establish a connection to lnd's RPC sever.
-	creds, err := credentials.NewClientTLSFromFile(tlsCertPath, "")
+	recipients, err := loadRecipients(
+		cfg.RecipientsFile, cfg.minAmount, cfg.maxAmount,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read cert file: %v", err)
+		return nil, fmt.Errorf("unable to load recipients: %v", err)
 	}
-	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
 
-	// Load the specified macaroon file.
-	macPath := cleanAndExpandPath(macaroonPath)
-	macBytes, err := ioutil.ReadFile(macPath)
+	endpoints, err := loadWebhooks(cfg.WebhooksFile)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to load webhooks: %v", err)
 	}
-	mac := &macaroon.Macaroon{}
-	if err = mac.UnmarshalBinary(macBytes); err != nil {
+
+	store, err := openTipStore(filepath.Join(cfg.dataDir, tipStoreFilename))
+	if err != nil {
 		return nil, err
 	}
 
-	// Now we append the macaroon credentials to the dial options.
-	opts = append(
-		opts,
-		grpc.WithPerRPCCredentials(macaroons.NewMacaroonCredential(mac)),
+	// Next attempt to establish a connection to lnd's RPC sever. The
+	// connection is re-established in the background whenever it's lost.
+	breaker := newCircuitBreaker(
+		cfg.LndBreakerFailures, cfg.LndBreakerCooldown,
+	)
+	conn, err := dialLnd(
+		cfg.LndNode, cfg.TLSCertPath, mac,
+		lndDialOptions(cfg, breaker)...,
 	)
-
-	conn, err := grpc.Dial(lndNode, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("unable to dial to lnd's gRPC server: %v", err)
+		store.Close()
+		return nil, err
 	}
 
 	// If we're able to connect out to the lnd node, then we can start up
 	// the faucet safely.
 	lnd := lnrpc.NewLightningClient(conn)
 
+	webhooks := newWebhookDispatcher(store, endpoints)
+	invoices, err := newInvoiceTracker(
+		lnd, filepath.Join(cfg.dataDir, legacyCursorFilename), store,
+		webhooks,
+	)
+	if err != nil {
+		conn.Close()
+		store.Close()
+		return nil, fmt.Errorf("unable to create invoice tracker: %v", err)
+	}
+
+	stats := newStatsCache(store, cfg.statsMemos, cfg.StatsLeaderboardSize)
+
+	var admin *adminAuth
+	if cfg.AdminPasswordHash != "" || cfg.AdminTOTPSecret != "" {
+		admin = newAdminAuth(
+			cfg.AdminPasswordHash, cfg.adminTOTPSecret,
+			cfg.AdminSessionTimeout,
+			strings.HasPrefix(cfg.PublicURL, "https://"),
+		)
+	}
+
+	var nodeInfo *nodeInfoMonitor
+	if canGetInfo(mac) {
+		nodeInfo = newNodeInfoMonitor(lnd, cfg.NodeInfoInterval)
+	} else {
+		log.Warnf("Not displaying the identity and sync state of the " +
+			"node, the macaroon doesn't allow getting node info " +
+			"(info:read)")
+	}
+
+	var liquidity *liquidityMonitor
+	switch {
+	case !cfg.CheckLiquidity:
+
+	case canListChannels(mac):
+		liquidity = newLiquidityMonitor(
+			lnd, cfg.LiquidityInterval, cfg.inboundAlertThreshold,
+		)
+
+	default:
+		log.Warnf("Not checking the inbound capacity of the node, the " +
+			"macaroon doesn't allow listing channels (offchain:read)")
+	}
+
+	// The reaper only closes channels once the node is known to be
+	// synced, which requires the node info.
+	var reaper *channelReaper
+	switch {
+	case cfg.FaucetMode != faucetModeOpenChannel || cfg.ReaperInterval <= 0:
+
+	case nodeInfo != nil:
+		reaper = newChannelReaper(lnd, nodeInfo, store, reaperConfig{
+			interval:        cfg.ReaperInterval,
+			maxChannels:     cfg.MaxChannels,
+			maxAge:          cfg.ChannelMaxAge,
+			inactiveTimeout: cfg.ChannelInactiveTimeout,
+			forceCloseGrace: cfg.ChannelForceCloseGrace,
+			closeTimeout:    cfg.LndRPCTimeout,
+		})
+
+	default:
+		log.Warnf("Not closing channels, the macaroon doesn't allow " +
+			"getting node info (info:read)")
+	}
+
+	var withdrawals *withdrawalReconciler
+	if cfg.EnableWithdrawals {
+		withdrawals = newWithdrawalReconciler(lnd, store)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
 	return &lightningFaucet{
-		lnd:       lnd,
-		templates: templates,
-		homePageContext: &homePageContext{
-			FormFields:            make(map[string]string),
-			GenerateInvoiceAction: GenerateInvoiceAction,
+		lnd:            lnd,
+		invoicesClient: invoicesrpc.NewInvoicesClient(conn),
+		conn:           conn,
+		ctx:            ctx,
+		cancel:         cancel,
+		templates:      templates,
+		invoices:       invoices,
+		webhooks:       webhooks,
+		eventStreams:   newEventStreams(cfg.MaxEventStreams),
+		nodeInfo:       nodeInfo,
+		liquidity:      liquidity,
+		reaper:         reaper,
+		withdrawals:    withdrawals,
+		breaker:        breaker,
+		store:          store,
+		stats:          stats,
+		limiter:        limiter,
+		publicURL:      cfg.PublicURL,
+
+		withdrawLimiter: withdrawLimiter,
+		loginLimiter:    loginLimiter,
+
+		widgets:    widgets,
+		recipients: recipients,
+		admin:      admin,
+		minAmount:  cfg.minAmount,
+		maxAmount:  cfg.maxAmount,
+
+		withdrawalsEnabled: cfg.EnableWithdrawals,
+		minWithdrawal:      cfg.minWithdrawal,
+		maxWithdrawal:      cfg.maxWithdrawal,
+		withdrawalMaxFee:   cfg.WithdrawalMaxFee,
+
+		invoiceOpts: invoiceOptions{
+			expiry:       cfg.InvoiceExpiry,
+			maxExpiry:    cfg.MaxInvoiceExpiry,
+			cltvExpiry:   cfg.InvoiceCltvExpiry,
+			private:      cfg.InvoicePrivate,
+			fallbackAddr: cfg.InvoiceFallbackAddr,
 		},
+		openAmounts: cfg.OpenAmount,
+
+		openChannels: cfg.FaucetMode == faucetModeOpenChannel,
 	}, nil
 }
 
+// Start launches the background subsystems of the faucet.
+func (l *lightningFaucet) Start() {
+	if l.nodeInfo != nil {
+		l.nodeInfo.Start(l.ctx)
+	}
+	l.invoices.Start(l.ctx)
+	l.webhooks.Start(l.ctx)
+	if l.liquidity != nil {
+		l.liquidity.Start(l.ctx)
+	}
+	if l.reaper != nil {
+		l.reaper.Start(l.ctx)
+	}
+	if l.withdrawals != nil {
+		l.withdrawals.Start(l.ctx)
+	}
+}
+
+// Stop aborts the requests to dcrlnd in flight, shuts down the background
+// subsystems of the faucet and closes the connection to dcrlnd and the tip
+// database.
+func (l *lightningFaucet) Stop() {
+	l.cancel()
+	l.eventStreams.Close()
+	l.invoices.Stop()
+	l.webhooks.Stop()
+	if l.withdrawals != nil {
+		l.withdrawals.Stop()
+	}
+	if l.reaper != nil {
+		l.reaper.Stop()
+	}
+	if l.liquidity != nil {
+		l.liquidity.Stop()
+	}
+	if l.nodeInfo != nil {
+		l.nodeInfo.Stop()
+	}
+
+	if err := l.conn.Close(); err != nil {
+		log.Errorf("Unable to close connection to dcrlnd: %v", err)
+	}
+	if err := l.store.Close(); err != nil {
+		log.Errorf("Unable to close tip database: %v", err)
+	}
+}
+
+// amountLimits returns the current limits of the amount of the invoices.
+func (l *lightningFaucet) amountLimits() (dcrutil.Amount, dcrutil.Amount) {
+	l.amountsMtx.RLock()
+	defer l.amountsMtx.RUnlock()
+
+	return l.minAmount, l.maxAmount
+}
+
+// setAmountLimits changes the limits of the amount of the invoices.
+func (l *lightningFaucet) setAmountLimits(minAmount, maxAmount dcrutil.Amount) {
+	l.amountsMtx.Lock()
+	defer l.amountsMtx.Unlock()
+
+	l.minAmount, l.maxAmount = minAmount, maxAmount
+}
+
 // cleanAndExpandPath expands environment variables and leading ~ in the passed
 // path, cleans the result, and returns it.
 // This function is taken from https://github.com/btcsuite/btcd
@@ -245,11 +794,122 @@ type homePageContext struct {
 	// InvoicePaymentRequest the payment request generated by an invoice.
 	InvoicePaymentRequest string
 
+	// InvoiceRHash is the hex encoded payment hash of the displayed
+	// invoice.
+	InvoiceRHash string
+
 	// GenerateInvoiceAction indicates the form action to generate a new Invoice
 	GenerateInvoiceAction string
 
 	// Node pubkey
 	NodePubkey string
+
+	// NodeAlias is the alias of the node.
+	NodeAlias string
+
+	// NodeNotSynced indicates the node is catching up with the chain and
+	// invoices can't be generated.
+	NodeNotSynced bool
+
+	// NodeUnavailable indicates the node can't currently be reached and
+	// invoices can't be generated.
+	NodeUnavailable bool
+
+	// InvoiceStatus is the settlement status of the displayed invoice.
+	InvoiceStatus invoiceStatus
+
+	// InvoiceExpiresAt is the unix time after which the displayed invoice
+	// can't be paid anymore, and InvoiceExpiresIn the time left until
+	// then as displayed by the countdown.
+	InvoiceExpiresAt int64
+	InvoiceExpiresIn string
+
+	// PublicURL is the base URL under which the faucet is reachable.
+	PublicURL string
+
+	// Widget is the widget being rendered by the embed page.
+	Widget *widget
+
+	// Recipient is the recipient of the tips requested through the page,
+	// nil for the tips to the node operator.
+	Recipient *recipient
+
+	// PagePath is the path of the page, where its form is submitted.
+	PagePath string
+
+	// MinAmount and MaxAmount are the limits of the amount of the
+	// invoices in DCR.
+	MinAmount string
+	MaxAmount string
+
+	// AmountUnits are the units the amount of an invoice may be entered
+	// in.
+	AmountUnits []string
+
+	// OpenAmounts indicates invoices of any amount may be requested.
+	OpenAmounts bool
+
+	// OpenChannels indicates the form to open a channel is displayed.
+	OpenChannels bool
+
+	// OpenChannelAction indicates the form action to open a channel.
+	OpenChannelAction string
+
+	// MinChannelSize and MaxChannelSize are the limits of the capacity of
+	// the channels in DCR.
+	MinChannelSize string
+	MaxChannelSize string
+
+	// ChannelRequested indicates the submitted form is the one to open a
+	// channel, so its errors aren't displayed on the invoice form.
+	ChannelRequested bool
+
+	// ChannelPoint is the funding outpoint of the channel opened for the
+	// visitor.
+	ChannelPoint string
+
+	// MaxReceivable is the largest amount in DCR the node can receive
+	// right now, empty if unknown.
+	MaxReceivable string
+
+	// recipientSlug is the slug of the recipient of the displayed
+	// invoice, if any.
+	recipientSlug string
+}
+
+// newHomePageContext returns a fresh context used to render a single request.
+// Every request gets its own context so the form fields, errors and invoices
+// of one visitor are never rendered to another.
+func (l *lightningFaucet) newHomePageContext() *homePageContext {
+	minAmount, maxAmount := l.amountLimits()
+	ctx := &homePageContext{
+		FormFields:            make(map[string]string),
+		GenerateInvoiceAction: GenerateInvoiceAction,
+		PublicURL:             l.publicURL,
+		PagePath:              "/",
+		MinAmount:             formatAmount(minAmount),
+		MaxAmount:             formatAmount(maxAmount),
+		AmountUnits:           amountUnitNames,
+		OpenAmounts:           l.openAmounts,
+		NodeUnavailable:       l.breaker.isOpen(),
+		OpenChannels:          l.openChannels,
+		OpenChannelAction:     OpenChannelAction,
+		MinChannelSize:        formatAmount(dcrutil.Amount(minChannelSize)),
+		MaxChannelSize:        formatAmount(dcrutil.Amount(maxChannelSize)),
+	}
+
+	if info := l.nodeInfo.snapshot(); info != nil {
+		ctx.NodePubkey = info.Pubkey
+		ctx.NodeAlias = info.Alias
+		ctx.NodeAddr = info.nodeAddr()
+		ctx.GitCommitHash = info.GitCommitHash
+		ctx.NodeNotSynced = !info.SyncedToChain
+	}
+	if capacity, _ := l.liquidity.snapshot(); capacity != nil {
+		ctx.MaxReceivable = formatAmount(capacity.MaxReceivable)
+	}
+
+	return ctx
 }
 
 // faucetHome renders the main home page for the faucet. This includes the form
@@ -258,140 +918,525 @@ type homePageContext struct {
 //
 // NOTE: This method implements the http.Handler interface.
 func (l *lightningFaucet) faucetHome(w http.ResponseWriter, r *http.Request) {
-	// First obtain the home template from our cache of pre-compiled
-	// templates.
-	homeTemplate := l.templates.Lookup("index.html")
+	homeState := l.newHomePageContext()
+
+	// Channels are only opened from the home page of the faucet, not
+	// those of the recipients or widgets.
+	if l.openChannels && r.Method == http.MethodPost &&
+		r.URL.Query().Get("action") == OpenChannelAction {
+
+		homeTemplate := l.templates.Lookup("index.html")
+		l.openChannelForm(homeTemplate, homeState, w, r)
+		return
+	}
+
+	l.renderForm("index.html", homeState, "/invoice/", w, r)
+}
+
+// renderButton renders the tip button for the faucet.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) renderButton(w http.ResponseWriter, r *http.Request) {
+	l.renderForm("button.html", l.newHomePageContext(), "/invoice/", w, r)
+}
+
+// renderForm renders the named template with the given context and handles
+// the submission of the invoice form when the request is a POST, redirecting
+// to the generated invoice under invoicePrefix. Each request must be rendered
+// with its own context so nothing submitted by a previous visitor is
+// displayed.
+func (l *lightningFaucet) renderForm(templateName string,
+	homeInfoContext *homePageContext, invoicePrefix string,
+	w http.ResponseWriter, r *http.Request) {
 
-	// In order to render the home template we'll need the necessary
-	// context, so we'll grab that from the lnd daemon now in order to get
-	// the most up to date state.
-	homeInfoContext := l.homePageContext
+	// First obtain the template from our cache of pre-compiled templates.
+	homeTemplate := l.templates.Lookup(templateName)
 
 	// If the method is GET, then we'll render the home page with the form
 	// itself.
 	switch {
 	case r.Method == http.MethodGet:
-		homeTemplate.Execute(w, homeInfoContext)
+		if err := homeTemplate.Execute(w, homeInfoContext); err != nil {
+			log.Errorf("unable to render %s: %v", templateName, err)
+		}
 
 	// Otherwise, if the method is POST, then the user is submitting the
-	// form to open a channel, so we'll pass that off to the openChannel
-	// handler.
+	// form to generate an invoice, so we'll pass that off to the
+	// generateInvoice handler.
 	case r.Method == http.MethodPost:
-		action, _ := r.URL.Query()["action"]
-
-		if action[0] == GenerateInvoiceAction {
-			l.generateInvoice(homeTemplate, homeInfoContext, w, r)
+		if r.URL.Query().Get("action") != GenerateInvoiceAction {
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
 		}
 
+		l.generateInvoice(
+			homeTemplate, homeInfoContext, invoicePrefix, w, r,
+		)
+
 	// If the method isn't either of those, then this is an error as we
 	// only support the two methods above.
 	default:
 		http.Error(w, "", http.StatusMethodNotAllowed)
 	}
-
-	return
 }
 
-// faucetHome renders the main home page for the faucet. This includes the form
-// to create channels, the network statistics, and the splash page upon channel
-// success.
+// invoicePage renders the home page displaying the invoice identified by the
+// payment hash in the URL. Generated invoices are shown through this page so
+// that each tipper only ever sees the invoice they requested.
 //
 // NOTE: This method implements the http.Handler interface.
-func (l *lightningFaucet) renderButton(w http.ResponseWriter, r *http.Request) {
-	// First obtain the home template from our cache of pre-compiled
-	// templates.
-	homeTemplate := l.templates.Lookup("button.html")
+func (l *lightningFaucet) invoicePage(w http.ResponseWriter, r *http.Request) {
+	homeState, ok := l.invoicePageContext(w, r)
+	if !ok {
+		return
+	}
 
-	// In order to render the home template we'll need the necessary
-	// context, so we'll grab that from the lnd daemon now in order to get
-	// the most up to date state.
-	homeInfoContext := l.homePageContext
+	homeTemplate := l.templates.Lookup("index.html")
+	if err := homeTemplate.Execute(w, homeState); err != nil {
+		log.Errorf("unable to render invoice page: %v", err)
+	}
+}
 
-	// If the method is GET, then we'll render the home page with the form
-	// itself.
+// visibleTip returns the tip with the given payment hash, and whether it may
+// be displayed. Only tips are exposed, never the other invoices of the node
+// nor the tips hidden by the operator, and unknown payment hashes are refused
+// before reaching dcrlnd.
+func (l *lightningFaucet) visibleTip(rHash []byte) (*tipRecord, bool) {
+	tip, err := l.store.fetchTip(rHash)
 	switch {
-	case r.Method == http.MethodGet:
-		homeTemplate.Execute(w, homeInfoContext)
+	case err == errTipNotFound:
+		return nil, false
+	case err != nil:
+		log.Errorf("Unable to fetch tip %x: %v", rHash, err)
+		return nil, false
+	}
 
-	// Otherwise, if the method is POST, then the user is submitting the
-	// form to open a channel, so we'll pass that off to the openChannel
-	// handler.
-	case r.Method == http.MethodPost:
-		action, _ := r.URL.Query()["action"]
+	return tip, !tip.Hidden
+}
+
+// invoicePageContext returns the context used to render the invoice
+// identified by the payment hash in the URL. If the invoice can't be found, a
+// not found error is written to the response.
+func (l *lightningFaucet) invoicePageContext(w http.ResponseWriter,
+	r *http.Request) (*homePageContext, bool) {
+
+	rHash, err := hex.DecodeString(mux.Vars(r)["rhash"])
+	if err != nil || len(rHash) != sha256.Size {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	tip, ok := l.visibleTip(rHash)
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	invoice, err := l.invoices.lookup(l.ctx, rHash)
+	if err != nil {
+		log.Debugf("Unable to lookup invoice %x: %v", rHash, err)
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	homeState := l.newHomePageContext()
+	if invoice.Value == 0 {
+		homeState.FormFields["AnyAmount"] = "1"
+	} else {
+		homeState.FormFields["Amt"] = formatAmount(
+			dcrutil.Amount(invoice.Value),
+		)
+	}
+	homeState.FormFields["Unit"] = defaultAmountUnit
+	homeState.FormFields["Description"] = invoice.Memo
+	homeState.FormFields["Nickname"] = tip.Nickname
+	homeState.recipientSlug = tip.Recipient
+	homeState.InvoicePaymentRequest = invoice.PaymentRequest
+	homeState.InvoiceRHash = hex.EncodeToString(rHash)
+	homeState.InvoiceStatus = invoice.status(time.Now())
+	homeState.InvoiceExpiresAt = invoice.expiresAt().Unix()
+	homeState.InvoiceExpiresIn = formatCountdown(
+		time.Until(invoice.expiresAt()),
+	)
 
-		if action[0] == GenerateInvoiceAction {
-			l.generateInvoice(homeTemplate, homeInfoContext, w, r)
+	return homeState, true
+}
+
+// formatCountdown formats the time left until an invoice expires as
+// [h:]mm:ss, the same way the countdown of the invoice pages does.
+func formatCountdown(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	secs := int64(d / time.Second)
+
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60,
+			secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// limitInvoiceRequest consumes a rate limiting token for the client issuing
+// the request. If the client has exceeded its rate, the Retry-After header is
+// set on the response and InvoiceTimeNotElapsed is returned.
+func (l *lightningFaucet) limitInvoiceRequest(w http.ResponseWriter,
+	r *http.Request) chanCreationError {
+
+	allowed, wait := l.limiter.allow(r)
+	if !allowed {
+		log.Debugf("Rate limited invoice request from %s",
+			l.limiter.clientIP(r))
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		rateLimited.inc()
+		recordInvoiceOutcome(InvoiceTimeNotElapsed)
+		return InvoiceTimeNotElapsed
+	}
+
+	return NoError
+}
+
+// invoiceRequest describes an invoice requested through the form or the
+// JSON API.
+type invoiceRequest struct {
+	// Amount is the requested amount expressed in Unit.
+	Amount string
+	Unit   string
+
+	// Memo is the description of the invoice.
+	Memo string
+
+	// Nickname is the name the tipper appears with on the leaderboard,
+	// empty to stay off it.
+	Nickname string
+
+	// RemoteAddr and UserAgent identify the client requesting the
+	// invoice.
+	RemoteAddr string
+	UserAgent  string
+
+	// Widget is the ID of the widget the invoice is requested through, if
+	// any.
+	Widget string
+
+	// Recipient is the slug of the recipient of the tip, empty for tips to
+	// the node operator.
+	Recipient string
+
+	// AnyAmount requests an invoice without an amount, the tipper paying
+	// whatever they choose. Amount and Unit are ignored.
+	AnyAmount bool
+
+	// Expiry, in seconds, and CltvExpiry override the defaults of the
+	// faucet when not zero, Private and FallbackAddr when not nil.
+	Expiry       int64
+	CltvExpiry   uint64
+	Private      *bool
+	FallbackAddr *bool
+}
+
+// invoiceOptions are the options of the invoices created by the faucet.
+type invoiceOptions struct {
+	// expiry is how long the invoices can be paid, and maxExpiry the
+	// longest expiry which may be requested.
+	expiry    time.Duration
+	maxExpiry time.Duration
+
+	// cltvExpiry is the CLTV delta of the final hop of the invoices, 0
+	// for the default of dcrlnd.
+	cltvExpiry uint64
+
+	// private indicates the invoices carry route hints to the node
+	// through its private channels, so it can be paid without any public
+	// channel.
+	private bool
+
+	// fallbackAddr indicates the invoices carry an on-chain address where
+	// they can be paid instead.
+	fallbackAddr bool
+}
+
+// resolve returns the options of the requested invoice: the defaults,
+// overridden by those set in the request.
+func (o *invoiceOptions) resolve(
+	req *invoiceRequest) (*invoiceOptions, chanCreationError) {
+
+	opts := *o
+	if req.Expiry != 0 {
+		// The expiry is compared in seconds, so huge ones can't
+		// overflow into the allowed range.
+		if req.Expiry < int64(minInvoiceExpiry/time.Second) ||
+			req.Expiry > int64(o.maxExpiry/time.Second) {
+
+			return nil, InvalidInvoiceExpiry
 		}
+		opts.expiry = time.Duration(req.Expiry) * time.Second
+	}
+	if req.CltvExpiry != 0 {
+		if req.CltvExpiry < minCltvExpiry ||
+			req.CltvExpiry > maxCltvExpiry {
 
-	// If the method isn't either of those, then this is an error as we
-	// only support the two methods above.
+			return nil, InvalidCltvExpiry
+		}
+		opts.cltvExpiry = req.CltvExpiry
+	}
+	if req.Private != nil {
+		opts.private = *req.Private
+	}
+	if req.FallbackAddr != nil {
+		opts.fallbackAddr = *req.FallbackAddr
+	}
+
+	return &opts, NoError
+}
+
+// invoiceAmount returns the amount of the requested invoice after checking it
+// against the limits, or zero for an invoice of any amount.
+func (l *lightningFaucet) invoiceAmount(req *invoiceRequest, minAmount,
+	maxAmount dcrutil.Amount) (dcrutil.Amount, chanCreationError) {
+
+	if req.AnyAmount {
+		if !l.openAmounts {
+			return 0, OpenAmountDisabled
+		}
+		return 0, NoError
+	}
+
+	amtAtoms, err := parseAmount(req.Amount, req.Unit)
+	switch err {
+	case nil:
+	case errAmountNegative:
+		return 0, InvoiceAmountNegative
+	case errAmountTooPrecise:
+		return 0, InvoiceAmountTooPrecise
+	case errAmountTooLarge:
+		return 0, InvoiceAmountTooHigh
 	default:
-		http.Error(w, "", http.StatusMethodNotAllowed)
+		return 0, ChanAmountNotNumber
+	}
+	if amtAtoms < minAmount {
+		return 0, InvoiceAmountTooLow
+	}
+	if amtAtoms > maxAmount {
+		log.Warnf("Attempt to generate high value invoice (%v) from %s",
+			amtAtoms, req.RemoteAddr)
+		return 0, InvoiceAmountTooHigh
 	}
 
-	return
+	return amtAtoms, NoError
+}
+
+// createInvoice validates the requested amount, description and nickname and,
+// if they check out, adds a new invoice to the node and records the tip. This
+// is shared by the HTML form and the JSON API so both apply the same rules.
+func (l *lightningFaucet) createInvoice(
+	req *invoiceRequest) (_ *lnrpc.AddInvoiceResponse,
+	submissionErr chanCreationError) {
+
+	defer func() {
+		recordInvoiceOutcome(submissionErr)
+	}()
+
+	if l.nodeInfo.notSynced() {
+		return nil, NodeNotSynced
+	}
+
+	nickname := strings.TrimSpace(req.Nickname)
+	if !validNickname(nickname) {
+		return nil, InvalidNickname
+	}
+
+	// Tips to a recipient are subject to their own limits.
+	minAmount, maxAmount := l.amountLimits()
+	if req.Recipient != "" {
+		rcpt, ok := l.recipients[req.Recipient]
+		if !ok {
+			return nil, UnknownRecipient
+		}
+		minAmount, maxAmount = l.recipientLimits(rcpt)
+	}
+
+	// The amount of open-amount invoices is only known once they're
+	// paid, so it's checked against the limits on settlement instead.
+	amtAtoms, submissionErr := l.invoiceAmount(req, minAmount, maxAmount)
+	if submissionErr != NoError {
+		return nil, submissionErr
+	}
+
+	opts, submissionErr := l.invoiceOpts.resolve(req)
+	if submissionErr != NoError {
+		return nil, submissionErr
+	}
+
+	// Invoices the node can't receive would only fail once the tipper
+	// tries to pay them. Open-amount invoices must at least allow paying
+	// the minimum.
+	receiveAtoms := amtAtoms
+	if req.AnyAmount {
+		receiveAtoms = minAmount
+	}
+	maxReceivable, ok := l.liquidity.maxReceivable(l.ctx)
+	if ok && receiveAtoms > maxReceivable {
+		log.Debugf("Refusing invoice for %v from %s, the node can only "+
+			"receive %v", receiveAtoms, req.RemoteAddr, maxReceivable)
+		return nil, InsufficientInboundCapacity
+	}
+
+	// An invoice can still be paid over Lightning without a fallback
+	// address, so failing to get one doesn't fail the request.
+	var fallbackAddr string
+	if opts.fallbackAddr {
+		addr, err := l.lnd.NewAddress(l.ctx, &lnrpc.NewAddressRequest{
+			// The address is reused until it receives funds, so
+			// requesting invoices can't exhaust the address gap of
+			// the wallet.
+			Type: lnrpc.NewAddressRequest_UNUSED_PUBKEY_HASH,
+		})
+		if err != nil {
+			log.Warnf("Unable to generate fallback address: %v", err)
+		} else {
+			fallbackAddr = addr.Address
+		}
+	}
+
+	// generate new invoice
+	now := time.Now()
+	invoiceReq := &lnrpc.Invoice{
+		CreationDate: now.Unix(),
+		Value:        int64(amtAtoms),
+		Memo:         req.Memo,
+		Expiry:       int64(opts.expiry / time.Second),
+		CltvExpiry:   opts.cltvExpiry,
+		FallbackAddr: fallbackAddr,
+		Private:      opts.private,
+	}
+	invoice, err := l.lnd.AddInvoice(l.ctx, invoiceReq)
+	if err != nil {
+		log.Errorf("Generate invoice failed: %v", err)
+		if isNodeUnavailable(err) {
+			return nil, NodeUnavailable
+		}
+		return nil, ErrorGeneratingInvoice
+	}
+
+	amountDesc := amtAtoms.String()
+	if req.AnyAmount {
+		amountDesc = "any amount"
+	}
+	if req.Recipient != "" {
+		log.Infof("Generated invoice #%d for %s to %s rhash=%064x",
+			invoice.AddIndex, amountDesc, req.Recipient, invoice.RHash)
+	} else {
+		log.Infof("Generated invoice #%d for %s rhash=%064x",
+			invoice.AddIndex, amountDesc, invoice.RHash)
+	}
+
+	// The limits of open-amount tips are recorded so the amount paid can
+	// be checked against them on settlement.
+	var policyMin, policyMax dcrutil.Amount
+	if req.AnyAmount {
+		policyMin, policyMax = minAmount, maxAmount
+	}
+
+	// Unrecorded tips are never credited to their recipient, and their
+	// invoice pages can't be displayed, so the invoice is canceled rather
+	// than handed out.
+	err = l.store.putTip(&tipRecord{
+		RHash:          invoice.RHash,
+		AddIndex:       invoice.AddIndex,
+		AmountAtoms:    int64(amtAtoms),
+		MinAtoms:       int64(policyMin),
+		MaxAtoms:       int64(policyMax),
+		Memo:           req.Memo,
+		PaymentRequest: invoice.PaymentRequest,
+		Nickname:       nickname,
+		RemoteAddr:     req.RemoteAddr,
+		UserAgent:      req.UserAgent,
+		Widget:         req.Widget,
+		Recipient:      req.Recipient,
+		State:          tipStateOpen,
+		CreatedAt:      time.Unix(now.Unix(), 0),
+		Expiry:         opts.expiry,
+	})
+	if err != nil {
+		log.Errorf("Unable to record invoice %x: %v", invoice.RHash, err)
+		l.cancelInvoice(invoice.RHash)
+		return nil, ErrorGeneratingInvoice
+	}
+
+	return invoice, NoError
+}
+
+// cancelInvoice cancels the invoice with the given payment hash so it can't
+// be paid anymore. Failures are only logged, as the invoice expires anyway.
+func (l *lightningFaucet) cancelInvoice(rHash []byte) {
+	_, err := l.invoicesClient.CancelInvoice(
+		l.ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: rHash},
+	)
+	if err != nil {
+		log.Errorf("Unable to cancel invoice %x: %v", rHash, err)
+		return
+	}
+
+	log.Infof("Canceled unrecorded invoice %x", rHash)
 }
 
 // generateInvoice is a hybrid http.Handler that handles: the validation of the
 // generate invoice form, rendering errors to the form, and finally generating
-// invoice if all the parameters check out.
+// invoice if all the parameters check out. On success the visitor is
+// redirected to the page of the generated invoice, found under invoicePrefix.
 func (l *lightningFaucet) generateInvoice(homeTemplate *template.Template,
-	homeState *homePageContext, w http.ResponseWriter, r *http.Request) {
+	homeState *homePageContext, invoicePrefix string, w http.ResponseWriter,
+	r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "unable to parse form", 500)
+		return
+	}
 
-	elapsed := time.Since(lastGeneratedInvoiceTime)
 	amt := r.FormValue("amt")
+	unit := r.FormValue("unit")
 	description := r.FormValue("description")
+	nickname := r.FormValue("nickname")
+	anyAmount := r.FormValue("any_amount")
 
 	homeState.FormFields["Amt"] = amt
+	homeState.FormFields["Unit"] = unit
 	homeState.FormFields["Description"] = description
+	homeState.FormFields["Nickname"] = nickname
+	homeState.FormFields["AnyAmount"] = anyAmount
 
-	// check if minimium timeout to generate invoice has passed
-	if elapsed < GenerateInvoiceTimeout {
-		homeState.SubmissionError = InvoiceTimeNotElapsed
+	// check if the client is allowed to generate another invoice
+	if submissionErr := l.limitInvoiceRequest(w, r); submissionErr != NoError {
+		homeState.SubmissionError = submissionErr
+		w.WriteHeader(http.StatusTooManyRequests)
 		homeTemplate.Execute(w, homeState)
 		return
 	}
-	lastGeneratedInvoiceTime = time.Now()
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "unable to parse form", 500)
-		return
-	}
 
-	amtDcr, err := strconv.ParseFloat(amt, 64)
-	if err != nil {
-		homeState.SubmissionError = ChanAmountNotNumber
-		homeTemplate.Execute(w, homeState)
-		return
+	req := &invoiceRequest{
+		Amount:     amt,
+		Unit:       unit,
+		Memo:       description,
+		Nickname:   nickname,
+		RemoteAddr: l.limiter.clientIP(r).String(),
+		UserAgent:  r.UserAgent(),
+		AnyAmount:  anyAmount != "",
 	}
-	if amtDcr > 0.2 {
-		log.Warnf("Attempt to generate high value invoice (%f) from %s",
-			amtDcr, r.RemoteAddr)
-		homeState.SubmissionError = InvoiceAmountTooHigh
-		homeTemplate.Execute(w, homeState)
-		return
+	if homeState.Widget != nil {
+		req.Widget = homeState.Widget.ID
 	}
-	amtAtoms := int64(amtDcr * 1e8)
-
-	// generate new invoice
-	invoiceReq := &lnrpc.Invoice{
-		CreationDate: time.Now().Unix(),
-		Value:        amtAtoms,
-		Memo:         description,
+	if homeState.Recipient != nil {
+		req.Recipient = homeState.Recipient.Slug
 	}
-	invoice, err := l.lnd.AddInvoice(ctxb, invoiceReq)
-	if err != nil {
-		log.Errorf("Generate invoice failed: %v", err)
-		homeState.SubmissionError = ErrorGeneratingInvoice
+
+	invoice, submissionErr := l.createInvoice(req)
+	if submissionErr != NoError {
+		homeState.SubmissionError = submissionErr
 		homeTemplate.Execute(w, homeState)
 		return
 	}
 
-	log.Infof("Generated invoice #%d for %s rhash=%064x", invoice.AddIndex,
-		dcrutil.Amount(amtAtoms), invoice.RHash)
-
-	homeState.InvoicePaymentRequest = invoice.PaymentRequest
-
-	if err := homeTemplate.Execute(w, homeState); err != nil {
-		log.Errorf("unable to render home page: %v", err)
-	}
+	invoiceURL := invoicePrefix + hex.EncodeToString(invoice.RHash)
+	http.Redirect(w, r, invoiceURL, http.StatusSeeOther)
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil"
+	"github.com/decred/dcrlnd/lnrpc"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+)
+
+// TestMain initializes the log rotator, as the loggers can't be used before,
+// within a temporary directory removed once the tests complete.
+func TestMain(m *testing.M) {
+	logDir, err := ioutil.TempDir("", "dcrtippin")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	initLogRotator(filepath.Join(logDir, defaultLogFilename))
+
+	code := m.Run()
+
+	logRotator.Close()
+	os.RemoveAll(logDir)
+	os.Exit(code)
+}
+
+// stubLightningClient is a lnrpc.LightningClient keeping the invoices it
+// adds in memory. Calling any other method panics.
+type stubLightningClient struct {
+	lnrpc.LightningClient
+
+	mtx      sync.Mutex
+	invoices map[[sha256.Size]byte]*lnrpc.Invoice
+	addIndex uint64
+}
+
+func newStubLightningClient() *stubLightningClient {
+	return &stubLightningClient{
+		invoices: make(map[[sha256.Size]byte]*lnrpc.Invoice),
+	}
+}
+
+// AddInvoice adds an open invoice whose payment request ends with its memo,
+// so the invoice displayed on a page can be told apart from the others.
+func (s *stubLightningClient) AddInvoice(ctx context.Context,
+	in *lnrpc.Invoice,
+	opts ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.addIndex++
+	var preimage [8]byte
+	binary.BigEndian.PutUint64(preimage[:], s.addIndex)
+	rHash := sha256.Sum256(preimage[:])
+
+	invoice := *in
+	invoice.RHash = rHash[:]
+	invoice.AddIndex = s.addIndex
+	invoice.PaymentRequest = fmt.Sprintf("lntdcr%d%s", s.addIndex, in.Memo)
+	invoice.State = lnrpc.Invoice_OPEN
+	s.invoices[rHash] = &invoice
+
+	return &lnrpc.AddInvoiceResponse{
+		RHash:          invoice.RHash,
+		PaymentRequest: invoice.PaymentRequest,
+		AddIndex:       invoice.AddIndex,
+	}, nil
+}
+
+func (s *stubLightningClient) LookupInvoice(ctx context.Context,
+	in *lnrpc.PaymentHash, opts ...grpc.CallOption) (*lnrpc.Invoice, error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var rHash [sha256.Size]byte
+	copy(rHash[:], in.RHash)
+	invoice, ok := s.invoices[rHash]
+	if !ok {
+		return nil, fmt.Errorf("unable to locate invoice")
+	}
+	c := *invoice
+	return &c, nil
+}
+
+// newStubFaucet returns a faucet backed by lnd, recording its tips in a
+// database within dir.
+func newStubFaucet(t *testing.T, lnd lnrpc.LightningClient,
+	dir string) *lightningFaucet {
+
+	store, err := openTipStore(filepath.Join(dir, tipStoreFilename))
+	if err != nil {
+		t.Fatalf("unable to open tip store: %v", err)
+	}
+	invoices, err := newInvoiceTracker(
+		lnd, filepath.Join(dir, legacyCursorFilename), store, nil,
+	)
+	if err != nil {
+		t.Fatalf("unable to create invoice tracker: %v", err)
+	}
+	limiter, err := newRateLimiter(1000, time.Millisecond, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("unable to create rate limiter: %v", err)
+	}
+	templates := template.Must(template.New("faucet").Funcs(customFuncs).
+		ParseGlob(filepath.Join("static", "*.html")))
+
+	return &lightningFaucet{
+		lnd:             lnd,
+		templates:       templates,
+		ctx:             context.Background(),
+		nodeInfo:        newNodeInfoMonitor(lnd, time.Hour),
+		breaker:         newCircuitBreaker(3, time.Minute),
+		store:           store,
+		invoices:        invoices,
+		limiter:         limiter,
+		withdrawLimiter: limiter,
+		loginLimiter:    limiter,
+		minAmount:       dcrutil.Amount(1),
+		maxAmount:       dcrutil.Amount(dcrutil.AtomsPerCoin),
+		invoiceOpts: invoiceOptions{
+			expiry:    defaultInvoiceExpiry,
+			maxExpiry: defaultMaxInvoiceExpiry,
+		},
+	}
+}
+
+// TestParallelSubmissions submits the invoice form concurrently, and checks
+// every tipper is only ever shown the invoice and the form fields they
+// submitted. Run it with -race to catch state shared between requests.
+func TestParallelSubmissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcrtippin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lnd := newStubLightningClient()
+	l := newStubFaucet(t, lnd, dir)
+	defer l.store.Close()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/", l.faucetHome)
+	router.HandleFunc("/invoice/{rhash}", l.invoicePage)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	const numTippers = 20
+	markerRe := regexp.MustCompile(`tipper\d+x`)
+	submitURL := server.URL + "/?action=" + GenerateInvoiceAction
+
+	var wg sync.WaitGroup
+	for i := 0; i < numTippers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Every other tipper submits an invalid amount, so the
+			// form is rendered again with their fields instead of
+			// redirecting them to their invoice.
+			marker := fmt.Sprintf("tipper%dx", i)
+			amt := "0.001"
+			if i%2 == 1 {
+				amt = marker
+			}
+			resp, err := http.PostForm(submitURL, url.Values{
+				"amt":         {amt},
+				"unit":        {defaultAmountUnit},
+				"description": {marker},
+			})
+			if err != nil {
+				t.Errorf("tipper %d: unable to submit form: %v", i,
+					err)
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Errorf("tipper %d: unable to read page: %v", i,
+					err)
+				return
+			}
+			page := string(body)
+
+			if i%2 == 0 {
+				if !strings.HasPrefix(resp.Request.URL.Path,
+					"/invoice/") {
+
+					t.Errorf("tipper %d: not redirected to "+
+						"their invoice: %v", i,
+						resp.Request.URL)
+				}
+				if !regexp.MustCompile(`lntdcr\d+` + marker).
+					MatchString(page) {
+
+					t.Errorf("tipper %d: invoice missing", i)
+				}
+			} else if !strings.Contains(page, ChanAmountNotNumber.String()) {
+				t.Errorf("tipper %d: submission error missing", i)
+			}
+
+			for _, m := range markerRe.FindAllString(page, -1) {
+				if m != marker {
+					t.Errorf("tipper %d: shown %s", i, m)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Nothing submitted shows up on the page of a new visitor.
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("unable to get home page: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unable to read home page: %v", err)
+	}
+	if m := markerRe.FindString(string(body)); m != "" {
+		t.Fatalf("home page shows %s", m)
+	}
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil"
+	"github.com/decred/dcrlnd/lnrpc"
+)
+
+const (
+	// defaultInvoiceExpiry is the expiry dcrlnd applies to invoices that
+	// are created without an explicit one.
+	defaultInvoiceExpiry = time.Hour
+
+	// minInvoiceExpiry is the shortest expiry of the invoices, leaving
+	// tippers the time to pay them.
+	minInvoiceExpiry = time.Minute
+
+	// minCltvExpiry and maxCltvExpiry are the limits of the CLTV delta of
+	// the final hop of the invoices, as enforced by dcrlnd.
+	minCltvExpiry = 9
+	maxCltvExpiry = math.MaxUint16
+
+	// subscribeMinBackoff is the time to wait before re-subscribing to
+	// invoice updates after the subscription to dcrlnd is lost. The wait
+	// doubles with every failed attempt up to subscribeMaxBackoff.
+	subscribeMinBackoff = time.Second
+
+	// subscribeMaxBackoff is the longest time to wait before
+	// re-subscribing to invoice updates.
+	subscribeMaxBackoff = time.Minute
+
+	// evictInterval is how often the expired invoices are evicted from
+	// the index of the tracker.
+	evictInterval = time.Minute
+)
+
+// invoiceStatus is the externally visible status of a tracked invoice.
+type invoiceStatus string
+
+const (
+	// invoiceStatusOpen indicates the invoice is waiting to be paid.
+	invoiceStatusOpen invoiceStatus = "open"
+
+	// invoiceStatusSettled indicates the invoice has been paid.
+	invoiceStatusSettled invoiceStatus = "settled"
+
+	// invoiceStatusExpired indicates the invoice was not paid before its
+	// expiry and can no longer be paid.
+	invoiceStatusExpired invoiceStatus = "expired"
+
+	// invoiceStatusCanceled indicates the invoice was canceled on the
+	// node.
+	invoiceStatusCanceled invoiceStatus = "canceled"
+)
+
+// trackedInvoice is the tracker's view of an invoice created on the node.
+type trackedInvoice struct {
+	RHash          []byte
+	AddIndex       uint64
+	SettleIndex    uint64
+	Value          int64
+	AmtPaidAtoms   int64
+	Memo           string
+	PaymentRequest string
+	CreationDate   time.Time
+	SettleDate     time.Time
+	Expiry         time.Duration
+	State          lnrpc.Invoice_InvoiceState
+}
+
+// newTrackedInvoice converts an invoice as returned by dcrlnd.
+func newTrackedInvoice(invoice *lnrpc.Invoice) *trackedInvoice {
+	t := &trackedInvoice{
+		RHash:          invoice.RHash,
+		AddIndex:       invoice.AddIndex,
+		SettleIndex:    invoice.SettleIndex,
+		Value:          invoice.Value,
+		AmtPaidAtoms:   invoice.AmtPaidAtoms,
+		Memo:           invoice.Memo,
+		PaymentRequest: invoice.PaymentRequest,
+		CreationDate:   time.Unix(invoice.CreationDate, 0),
+		Expiry:         time.Duration(invoice.Expiry) * time.Second,
+		State:          invoice.State,
+	}
+	if invoice.SettleDate != 0 {
+		t.SettleDate = time.Unix(invoice.SettleDate, 0)
+	}
+	if t.Expiry == 0 {
+		t.Expiry = defaultInvoiceExpiry
+	}
+
+	// Older nodes only set the deprecated settled flag.
+	if invoice.Settled {
+		t.State = lnrpc.Invoice_SETTLED
+	}
+
+	return t
+}
+
+// newTrackedTip converts a tip whose outcome was recorded, so the invoice
+// doesn't need to be looked up on the node.
+func newTrackedTip(tip *tipRecord) *trackedInvoice {
+	t := &trackedInvoice{
+		RHash:          tip.RHash,
+		AddIndex:       tip.AddIndex,
+		Value:          tip.AmountAtoms,
+		AmtPaidAtoms:   tip.AmtPaidAtoms,
+		Memo:           tip.Memo,
+		PaymentRequest: tip.PaymentRequest,
+		CreationDate:   tip.CreatedAt,
+		SettleDate:     tip.SettledAt,
+		Expiry:         tip.Expiry,
+	}
+	switch tip.State {
+	case tipStateSettled:
+		t.State = lnrpc.Invoice_SETTLED
+	case tipStateCanceled:
+		t.State = lnrpc.Invoice_CANCELED
+	}
+
+	return t
+}
+
+// final returns whether the invoice was settled or canceled, which it can't
+// come back from.
+func (t *trackedInvoice) final() bool {
+	return t.State == lnrpc.Invoice_SETTLED ||
+		t.State == lnrpc.Invoice_CANCELED
+}
+
+// supersedes returns whether the invoice is at least as recent as old, so a
+// reply of dcrlnd which raced a more recent event doesn't revert the invoice.
+func (t *trackedInvoice) supersedes(old *trackedInvoice) bool {
+	if t.final() != old.final() {
+		return t.final()
+	}
+
+	return t.AddIndex >= old.AddIndex && t.SettleIndex >= old.SettleIndex
+}
+
+// expiresAt returns the time after which the invoice can't be paid anymore.
+func (t *trackedInvoice) expiresAt() time.Time {
+	return t.CreationDate.Add(t.Expiry)
+}
+
+// status returns the status of the invoice at the given time.
+func (t *trackedInvoice) status(now time.Time) invoiceStatus {
+	switch {
+	case t.State == lnrpc.Invoice_SETTLED:
+		return invoiceStatusSettled
+	case t.State == lnrpc.Invoice_CANCELED:
+		return invoiceStatusCanceled
+	case now.After(t.expiresAt()):
+		return invoiceStatusExpired
+	default:
+		return invoiceStatusOpen
+	}
+}
+
+// invoiceCursor records the indexes of the most recent invoice events seen
+// by the tracker so that a restarted tracker resumes where it left off.
+type invoiceCursor struct {
+	AddIndex    uint64 `json:"add_index"`
+	SettleIndex uint64 `json:"settle_index"`
+}
+
+// invoiceTracker consumes the invoice subscription of dcrlnd and keeps an
+// index of the open tips keyed by their payment hash. Tips are evicted from
+// the index once settled, canceled or expired, after which they're served
+// from the store. The indexes of the last seen events are persisted along with
+// the outcome of the tips, so that no settlement is missed across restarts.
+type invoiceTracker struct {
+	lnd lnrpc.LightningClient
+
+	// store is updated with the outcome of the tips and the subscription
+	// cursor.
+	store *tipStore
+
+	// webhooks is woken up when a tip is settled, as the settlement
+	// queues its notifications.
+	webhooks *webhookDispatcher
+
+	mtx      sync.RWMutex
+	invoices map[string]*trackedInvoice
+	cursor   invoiceCursor
+
+	// expired is the number of tips evicted from the index because they
+	// expired unpaid.
+	expired uint64
+
+	// watchers are signaled whenever the invoice with their payment hash
+	// is updated.
+	watchers map[string]map[chan struct{}]struct{}
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newInvoiceTracker creates a new tracker which persists its subscription
+// cursor in store, loading any cursor left by a previous run. The settlement
+// of the tips is recorded in store and notified to webhooks. A cursor left at
+// legacyCursorPath by older versions is moved into the store.
+func newInvoiceTracker(lnd lnrpc.LightningClient, legacyCursorPath string,
+	store *tipStore, webhooks *webhookDispatcher) (*invoiceTracker, error) {
+
+	t := &invoiceTracker{
+		lnd:      lnd,
+		store:    store,
+		webhooks: webhooks,
+		invoices: make(map[string]*trackedInvoice),
+		watchers: make(map[string]map[chan struct{}]struct{}),
+	}
+
+	cursor, found, err := store.fetchInvoiceCursor()
+	if err != nil {
+		return nil, err
+	}
+	t.cursor = cursor
+	if found {
+		return t, nil
+	}
+
+	cursorBytes, err := ioutil.ReadFile(legacyCursorPath)
+	switch {
+	case os.IsNotExist(err):
+		return t, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(cursorBytes, &t.cursor); err != nil {
+		return nil, err
+	}
+	if err := store.putInvoiceCursor(t.cursor); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(legacyCursorPath); err != nil {
+		invcLog.Warnf("Unable to remove %s: %v", legacyCursorPath, err)
+	}
+
+	return t, nil
+}
+
+// Start launches the goroutines that consume invoice updates from dcrlnd and
+// evict the expired tips until ctx is canceled or the tracker is stopped.
+func (t *invoiceTracker) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+
+	t.wg.Add(2)
+	go t.subscribe(ctx)
+	go t.evictExpired(ctx)
+}
+
+// Stop terminates the subscription and waits for it to exit.
+func (t *invoiceTracker) Stop() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// subscribe keeps a subscription to invoice updates open until ctx is
+// canceled, re-subscribing from the last seen indexes whenever the stream to
+// dcrlnd breaks.
+//
+// NOTE: This MUST be run as a goroutine.
+func (t *invoiceTracker) subscribe(ctx context.Context) {
+	defer t.wg.Done()
+
+	backoff := subscribeMinBackoff
+	for {
+		t.mtx.RLock()
+		req := &lnrpc.InvoiceSubscription{
+			AddIndex:    t.cursor.AddIndex,
+			SettleIndex: t.cursor.SettleIndex,
+		}
+		t.mtx.RUnlock()
+
+		invcLog.Debugf("Subscribing to invoices from add_index=%d "+
+			"settle_index=%d", req.AddIndex, req.SettleIndex)
+
+		start := time.Now()
+		err := t.consume(ctx, req)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A subscription that lasted a while was healthy, so the next
+		// attempt starts over with a short wait.
+		if time.Since(start) > subscribeMaxBackoff {
+			backoff = subscribeMinBackoff
+		}
+		invcLog.Errorf("Invoice subscription failed, retrying in %v: %v",
+			backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > subscribeMaxBackoff {
+			backoff = subscribeMaxBackoff
+		}
+	}
+}
+
+// consume reads invoice updates from a single subscription until it fails.
+// An update which can't be recorded also ends the subscription, so it's
+// delivered again once re-subscribed from the stored cursor.
+func (t *invoiceTracker) consume(ctx context.Context,
+	req *lnrpc.InvoiceSubscription) error {
+
+	stream, err := t.lnd.SubscribeInvoices(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		invoice, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if err := t.handleEvent(invoice); err != nil {
+			return err
+		}
+	}
+}
+
+// handleEvent records an invoice received through the subscription. The
+// outcome of its tip is stored along with the cursor moved past it, and only
+// then is the invoice indexed. Invoices obtained by other means must not move
+// the cursor, as that could skip events the subscription hasn't delivered
+// yet.
+func (t *invoiceTracker) handleEvent(invoice *lnrpc.Invoice) error {
+	tracked := newTrackedInvoice(invoice)
+
+	// The cursor is only changed by the subscription goroutine.
+	t.mtx.RLock()
+	cursor := t.cursor
+	t.mtx.RUnlock()
+	if tracked.AddIndex > cursor.AddIndex {
+		cursor.AddIndex = tracked.AddIndex
+	}
+	if tracked.SettleIndex > cursor.SettleIndex {
+		cursor.SettleIndex = tracked.SettleIndex
+	}
+
+	var violation string
+	update := tipOutcome(tracked, &violation)
+	isTip, err := t.store.recordInvoiceEvent(tracked.RHash, update, cursor)
+	if err != nil {
+		return fmt.Errorf("unable to record invoice #%d: %v",
+			tracked.AddIndex, err)
+	}
+
+	t.mtx.Lock()
+	t.cursor = cursor
+	t.mtx.Unlock()
+
+	// Only the tips are indexed. A tip whose invoice was just added may
+	// not be stored yet, in which case it's indexed once looked up.
+	if !isTip {
+		return nil
+	}
+	t.index(tracked)
+	if update == nil {
+		return nil
+	}
+	t.outcomeRecorded(tracked, violation)
+
+	// Only the tips newly recorded as settled are counted, so neither the
+	// other invoices of the node nor replayed events inflate the metrics.
+	if tracked.State == lnrpc.Invoice_SETTLED {
+		invoicesSettled.inc()
+		atomsTipped.add(float64(tracked.AmtPaidAtoms))
+		invcLog.Infof("Invoice #%d settled for %v rhash=%x",
+			tracked.AddIndex, dcrutil.Amount(tracked.AmtPaidAtoms),
+			tracked.RHash)
+	}
+
+	return nil
+}
+
+// index records the given tip in the index and signals its watchers,
+// returning the most recent view of it. The tip is only kept in the index
+// while it's open.
+func (t *invoiceTracker) index(tracked *trackedInvoice) *trackedInvoice {
+	key := hex.EncodeToString(tracked.RHash)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	old, ok := t.invoices[key]
+	if ok && !tracked.supersedes(old) {
+		tracked = old
+	}
+
+	// A reply of dcrlnd may predate an outcome which was already recorded
+	// and evicted, in which case the store has the last word.
+	if !tracked.final() {
+		tip, err := t.store.fetchTip(tracked.RHash)
+		if err == nil && tip.State != tipStateOpen {
+			tracked = newTrackedTip(tip)
+		}
+	}
+
+	switch tracked.status(time.Now()) {
+	case invoiceStatusOpen:
+		t.invoices[key] = tracked
+	case invoiceStatusExpired:
+		if ok {
+			t.expired++
+		}
+		delete(t.invoices, key)
+	default:
+		delete(t.invoices, key)
+	}
+
+	for c := range t.watchers[key] {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+
+	return tracked
+}
+
+// evictExpired evicts the tips which expired unpaid from the index every
+// evictInterval until ctx is canceled.
+//
+// NOTE: This MUST be run as a goroutine.
+func (t *invoiceTracker) evictExpired(ctx context.Context) {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			t.mtx.Lock()
+			for key, invoice := range t.invoices {
+				if invoice.status(now) == invoiceStatusExpired {
+					delete(t.invoices, key)
+					t.expired++
+				}
+			}
+			t.mtx.Unlock()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tipOutcome returns the update recording the settlement or cancellation of
+// the invoice on its tip, nil while the invoice is open. The update sets
+// violation when an open-amount tip was paid outside of its limits.
+func tipOutcome(tracked *trackedInvoice, violation *string) func(*tipRecord) {
+	var state tipState
+	switch tracked.State {
+	case lnrpc.Invoice_SETTLED:
+		state = tipStateSettled
+	case lnrpc.Invoice_CANCELED:
+		state = tipStateCanceled
+	default:
+		return nil
+	}
+
+	return func(tip *tipRecord) {
+		tip.State = state
+		tip.AmtPaidAtoms = tracked.AmtPaidAtoms
+		tip.SettledAt = tracked.SettleDate
+		tip.Expiry = tracked.Expiry
+		*violation = tip.policyViolation()
+	}
+}
+
+// recordOutcome stores the settlement or cancellation of a tip. Invoices
+// which weren't created through the faucet aren't tips and are ignored.
+func (t *invoiceTracker) recordOutcome(tracked *trackedInvoice) {
+	var violation string
+	update := tipOutcome(tracked, &violation)
+	if update == nil {
+		return
+	}
+
+	err := t.store.updateTip(tracked.RHash, update)
+	switch {
+	case err == nil:
+		t.outcomeRecorded(tracked, violation)
+
+	case err != errTipNotFound:
+		invcLog.Errorf("Unable to record outcome of invoice %x: %v",
+			tracked.RHash, err)
+	}
+}
+
+// outcomeRecorded reports the recorded settlement of a tip to the operator
+// and wakes up the webhooks it queued.
+func (t *invoiceTracker) outcomeRecorded(tracked *trackedInvoice,
+	violation string) {
+
+	if tracked.State != lnrpc.Invoice_SETTLED {
+		return
+	}
+
+	// The payment of an open-amount tip can't be refused once it arrived,
+	// so amounts outside of the limits are only reported to the operator.
+	if violation != "" {
+		openAmountViolations.inc(violation)
+		invcLog.Warnf("Open-amount invoice #%d paid %v outside of the "+
+			"amount limits (%s) rhash=%x", tracked.AddIndex,
+			dcrutil.Amount(tracked.AmtPaidAtoms), violation,
+			tracked.RHash)
+	}
+	t.webhooks.wake()
+}
+
+// numExpired returns the number of tips which expired unpaid while indexed.
+func (t *invoiceTracker) numExpired() uint64 {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	return t.expired
+}
+
+// watch returns a channel signaled whenever the invoice with the given payment
+// hash is updated, along with a function to stop watching it. Signals are
+// coalesced, so the invoice must be looked up again once signaled.
+func (t *invoiceTracker) watch(rHash []byte) (<-chan struct{}, func()) {
+	key := hex.EncodeToString(rHash)
+	c := make(chan struct{}, 1)
+
+	t.mtx.Lock()
+	if t.watchers[key] == nil {
+		t.watchers[key] = make(map[chan struct{}]struct{})
+	}
+	t.watchers[key][c] = struct{}{}
+	t.mtx.Unlock()
+
+	stop := func() {
+		t.mtx.Lock()
+		delete(t.watchers[key], c)
+		if len(t.watchers[key]) == 0 {
+			delete(t.watchers, key)
+		}
+		t.mtx.Unlock()
+	}
+
+	return c, stop
+}
+
+// lookup returns the tip with the given payment hash, or errTipNotFound if
+// there's none. Open tips not yet indexed are fetched from dcrlnd and added to
+// the index, while the others are served from the store.
+func (t *invoiceTracker) lookup(ctx context.Context,
+	rHash []byte) (*trackedInvoice, error) {
+
+	t.mtx.RLock()
+	tracked, ok := t.invoices[hex.EncodeToString(rHash)]
+	t.mtx.RUnlock()
+	if ok {
+		return tracked, nil
+	}
+
+	tip, err := t.store.fetchTip(rHash)
+	if err != nil {
+		return nil, err
+	}
+	if tip.State != tipStateOpen {
+		return newTrackedTip(tip), nil
+	}
+
+	invoice, err := t.lnd.LookupInvoice(ctx, &lnrpc.PaymentHash{
+		RHash: rHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t.index(newTrackedInvoice(invoice)), nil
+}
+
+// refresh fetches the invoice with the given payment hash from dcrlnd,
+// updating the index and the outcome of its tip. This is used after the
+// invoice was changed through the faucet, such as when it's canceled, as the
+// subscription doesn't report every change of state.
+func (t *invoiceTracker) refresh(ctx context.Context,
+	rHash []byte) (*trackedInvoice, error) {
+
+	invoice, err := t.lnd.LookupInvoice(ctx, &lnrpc.PaymentHash{
+		RHash: rHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The outcome is recorded first, as the index defers to the store.
+	tracked := newTrackedInvoice(invoice)
+	t.recordOutcome(tracked)
+
+	return t.index(tracked), nil
+}
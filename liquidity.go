@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil"
+	"github.com/decred/dcrlnd/lnrpc"
+)
+
+// channelReserveDivisor is the fraction of the capacity of a channel each
+// party must keep on its side, 1% by default in dcrlnd. The remote node can't
+// send the funds it must keep as reserve.
+const channelReserveDivisor = 100
+
+// inboundCapacity is a snapshot of how much the node can receive over its
+// active channels.
+type inboundCapacity struct {
+	// MaxReceivable is the largest payment the node can receive. Payments
+	// aren't split across channels, so this is the receivable amount of
+	// the channel able to receive the most.
+	MaxReceivable dcrutil.Amount
+
+	// TotalReceivable is the sum of the receivable amounts of the active
+	// channels.
+	TotalReceivable dcrutil.Amount
+
+	// NumActiveChannels is the number of channels the receivable amounts
+	// were computed from.
+	NumActiveChannels int
+
+	// Updated is the time the snapshot was taken.
+	Updated time.Time
+}
+
+// channelReceivable returns the amount the node can receive over the
+// channel: the balance of the remote node minus the reserve it must keep.
+func channelReceivable(channel *lnrpc.Channel) dcrutil.Amount {
+	reserve := channel.Capacity / channelReserveDivisor
+	if channel.RemoteBalance <= reserve {
+		return 0
+	}
+
+	return dcrutil.Amount(channel.RemoteBalance - reserve)
+}
+
+// newInboundCapacity computes the inbound capacity of the node from its
+// channels. Inactive channels are ignored, as nothing can be received over
+// them until the remote node comes back.
+func newInboundCapacity(channels []*lnrpc.Channel) *inboundCapacity {
+	c := &inboundCapacity{Updated: time.Now()}
+	for _, channel := range channels {
+		if !channel.Active {
+			continue
+		}
+
+		receivable := channelReceivable(channel)
+		if receivable > c.MaxReceivable {
+			c.MaxReceivable = receivable
+		}
+		c.TotalReceivable += receivable
+		c.NumActiveChannels++
+	}
+
+	return c
+}
+
+// liquidityMonitor periodically computes the inbound capacity of the node,
+// alerting the operator when the node can no longer receive tips of the alert
+// threshold. The capacity is also refreshed before every invoice, so tips the
+// node can't receive are refused.
+type liquidityMonitor struct {
+	lnd      lnrpc.LightningClient
+	interval time.Duration
+
+	// threshold is the receivable amount below which the operator is
+	// alerted, 0 to never alert.
+	threshold dcrutil.Amount
+
+	mtx      sync.RWMutex
+	capacity *inboundCapacity
+	low      bool
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newLiquidityMonitor creates a monitor refreshing the inbound capacity every
+// interval and alerting below threshold.
+func newLiquidityMonitor(lnd lnrpc.LightningClient, interval time.Duration,
+	threshold dcrutil.Amount) *liquidityMonitor {
+
+	return &liquidityMonitor{
+		lnd:       lnd,
+		interval:  interval,
+		threshold: threshold,
+	}
+}
+
+// Start computes the inbound capacity and launches the goroutine which keeps
+// it up to date until ctx is canceled or the monitor is stopped.
+func (m *liquidityMonitor) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+
+	if _, err := m.refresh(ctx); err != nil {
+		log.Warnf("Unable to compute inbound capacity: %v", err)
+	}
+
+	m.wg.Add(1)
+	go m.poll(ctx)
+}
+
+// Stop terminates the monitor and waits for it to exit.
+func (m *liquidityMonitor) Stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// poll refreshes the inbound capacity every interval until ctx is canceled.
+//
+// NOTE: This MUST be run as a goroutine.
+func (m *liquidityMonitor) poll(ctx context.Context) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := m.refresh(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Warnf("Unable to compute inbound capacity: %v",
+					err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh lists the channels of the node and stores the resulting inbound
+// capacity, alerting the operator when it crosses the threshold. On failure
+// the previous snapshot is kept.
+func (m *liquidityMonitor) refresh(ctx context.Context) (*inboundCapacity, error) {
+	resp, err := m.lnd.ListChannels(ctx, &lnrpc.ListChannelsRequest{
+		ActiveOnly: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	capacity := newInboundCapacity(resp.Channels)
+
+	m.mtx.Lock()
+	m.capacity = capacity
+	wasLow := m.low
+	m.low = m.threshold > 0 && capacity.MaxReceivable < m.threshold
+	m.mtx.Unlock()
+
+	switch {
+	case m.low && !wasLow:
+		log.Warnf("Inbound capacity dropped to %v over %d active "+
+			"channels, below the alert threshold of %v: tips above "+
+			"it are refused", capacity.MaxReceivable,
+			capacity.NumActiveChannels, m.threshold)
+	case !m.low && wasLow:
+		log.Infof("Inbound capacity recovered to %v",
+			capacity.MaxReceivable)
+	}
+
+	return capacity, nil
+}
+
+// snapshot returns the most recent inbound capacity and whether it's below
+// the alert threshold. The capacity is nil if it couldn't be computed yet,
+// or if the monitor itself is nil because the macaroon doesn't allow listing
+// the channels. The returned value must not be modified.
+func (m *liquidityMonitor) snapshot() (*inboundCapacity, bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.capacity, m.low
+}
+
+// maxReceivable refreshes the inbound capacity and returns the largest
+// payment the node can receive right now. False is returned when it's
+// unknown, in which case invoices shouldn't be refused, as dcrlnd is the
+// final judge of what can be received.
+func (m *liquidityMonitor) maxReceivable(ctx context.Context) (dcrutil.Amount, bool) {
+	if m == nil {
+		return 0, false
+	}
+
+	capacity, err := m.refresh(ctx)
+	if err != nil {
+		log.Debugf("Unable to compute inbound capacity: %v", err)
+		return 0, false
+	}
+
+	return capacity.MaxReceivable, true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// lndKeepaliveTimeout is how long to wait for the answer to a
+	// keepalive ping before considering the connection dead.
+	lndKeepaliveTimeout = 20 * time.Second
+)
+
+var (
+	// errNodeUnavailable is returned without contacting dcrlnd while the
+	// circuit breaker is open.
+	errNodeUnavailable = status.Error(codes.Unavailable, "node unavailable")
+)
+
+// circuitBreaker keeps track of the consecutive failures to reach dcrlnd.
+// Once too many requests fail in a row the breaker opens and requests fail
+// immediately instead of waiting on an unresponsive node. After a cooldown a
+// single request is let through to probe the node, closing the breaker if it
+// succeeds.
+type circuitBreaker struct {
+	maxFailures int
+	cooldown    time.Duration
+
+	mtx       sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// newCircuitBreaker creates a breaker that opens after maxFailures
+// consecutive failures and stays open for cooldown.
+func newCircuitBreaker(maxFailures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+	}
+}
+
+// allow reports whether a request may be sent to dcrlnd.
+func (b *circuitBreaker) allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.failures < b.maxFailures {
+		return true
+	}
+
+	// Once the cooldown elapses a single probe is let through.
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+
+	return true
+}
+
+// record updates the breaker with the outcome of a request. Only errors
+// indicating dcrlnd couldn't be reached count as failures, rejected requests
+// prove the node is up. Canceled requests, such as those aborted when the
+// faucet shuts down, say nothing about the node.
+func (b *circuitBreaker) record(err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.probing = false
+
+	if status.Code(err) == codes.Canceled {
+		return
+	}
+
+	if !isNodeUnavailable(err) {
+		if b.failures >= b.maxFailures {
+			log.Infof("Connection to dcrlnd restored")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.maxFailures {
+		if b.failures == b.maxFailures {
+			log.Warnf("Unable to reach dcrlnd, failing requests for "+
+				"%v: %v", b.cooldown, err)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// isOpen reports whether dcrlnd is considered unavailable.
+func (b *circuitBreaker) isOpen() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.failures >= b.maxFailures
+}
+
+// unaryInterceptor applies the per-call deadline to the unary requests to
+// dcrlnd, passes them through the circuit breaker and records their latency.
+func (b *circuitBreaker) unaryInterceptor(
+	timeout time.Duration) grpc.UnaryClientInterceptor {
+
+	return func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+
+		if !b.allow() {
+			return errNodeUnavailable
+		}
+
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		lndLatency.observe(time.Since(start), method)
+		b.record(err)
+
+		return err
+	}
+}
+
+// lndDialOptions returns the options used to connect to dcrlnd: keepalives
+// detect dead connections, which are re-established with exponential
+// backoff, and unary requests go through the circuit breaker.
+func lndDialOptions(cfg *config, breaker *circuitBreaker) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    cfg.LndKeepalive,
+			Timeout: lndKeepaliveTimeout,
+		}),
+		grpc.WithBackoffMaxDelay(cfg.LndMaxBackoff),
+		grpc.WithUnaryInterceptor(
+			breaker.unaryInterceptor(cfg.LndRPCTimeout),
+		),
+	}
+}
+
+// isNodeUnavailable reports whether err indicates dcrlnd couldn't be reached.
+func isNodeUnavailable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+
+	return false
+}
@@ -42,7 +42,10 @@ var (
 	// application shutdown.
 	logRotator *rotator.Rotator
 
-	log = backendLog.Logger("FAUC")
+	log     = backendLog.Logger("FAUC")
+	invcLog = backendLog.Logger("INVC")
+	hookLog = backendLog.Logger("HOOK")
+	chanLog = backendLog.Logger("CHAN")
 )
 
 // Initialize package-global logger variables.
@@ -52,6 +55,9 @@ func init() {
 // subsystemLoggers maps each subsystem identifier to its associated logger.
 var subsystemLoggers = map[string]slog.Logger{
 	"FAUC": log,
+	"INVC": invcLog,
+	"HOOK": hookLog,
+	"CHAN": chanLog,
 }
 
 // initLogRotator initializes the logging rotater to write logs to logFile and
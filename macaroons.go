@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/decred/dcrlnd/macaroons"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// adminMacaroonFilename is the name of the macaroon dcrlnd creates
+	// with full access to the node.
+	adminMacaroonFilename = "admin.macaroon"
+
+	// bakedMacaroonFilename is the name of the macaroon created by the
+	// bakemacaroon command.
+	bakedMacaroonFilename = "dcrtippin.macaroon"
+
+	// bakeMacaroonMethod is the full name of dcrlnd's BakeMacaroon RPC.
+	bakeMacaroonMethod = "/lnrpc.Lightning/BakeMacaroon"
+
+	// macaroonIDVersion is the version of the bakery macaroon IDs which
+	// carry their operations encoded within the ID.
+	macaroonIDVersion = 3
+)
+
+var (
+	// tippinPermissions are the permissions required by the faucet to
+	// generate invoices, track their settlement and display the node's
+	// identity.
+	tippinPermissions = []macaroonOp{
+		{entity: "invoices", actions: []string{"read", "write"}},
+		{entity: "info", actions: []string{"read"}},
+	}
+
+	// fallbackAddrPermissions are the permissions required to generate
+	// the fallback addresses of the invoices.
+	fallbackAddrPermissions = []macaroonOp{
+		{entity: "address", actions: []string{"write"}},
+	}
+
+	// nodeInfoPermissions are the permissions required to get the
+	// identity and sync state of the node.
+	nodeInfoPermissions = []macaroonOp{
+		{entity: "info", actions: []string{"read"}},
+	}
+
+	// listChannelsPermissions are the permissions required to list the
+	// channels of the node.
+	listChannelsPermissions = []macaroonOp{
+		{entity: "offchain", actions: []string{"read"}},
+	}
+
+	// fundsPermissions are the permissions which allow the holder of a
+	// macaroon to move funds out of the node, either directly or by
+	// baking a more powerful macaroon.
+	fundsPermissions = []macaroonOp{
+		{entity: "onchain", actions: []string{"write"}},
+		{entity: "offchain", actions: []string{"write"}},
+		{entity: "macaroon", actions: []string{"generate"}},
+	}
+
+	// withdrawalPermissions are the permissions required to pay the
+	// withdrawals of the recipients.
+	withdrawalPermissions = []macaroonOp{
+		{entity: "offchain", actions: []string{"write"}},
+	}
+
+	// channelPermissions are the permissions required to open channels to
+	// the nodes of the visitors.
+	channelPermissions = []macaroonOp{
+		{entity: "onchain", actions: []string{"write"}},
+		{entity: "offchain", actions: []string{"read", "write"}},
+		{entity: "peers", actions: []string{"read", "write"}},
+	}
+
+	// errUnknownMacaroonFormat is returned when the permissions of a
+	// macaroon can't be decoded from its ID.
+	errUnknownMacaroonFormat = errors.New("unknown macaroon id format")
+)
+
+// macaroonOp is a permission granted by a macaroon: the actions allowed on an
+// entity.
+type macaroonOp struct {
+	entity  string
+	actions []string
+}
+
+// loadMacaroon reads the macaroon stored at the given path.
+func loadMacaroon(path string) (*macaroon.Macaroon, error) {
+	macBytes, err := ioutil.ReadFile(cleanAndExpandPath(path))
+	if err != nil {
+		return nil, err
+	}
+	mac := &macaroon.Macaroon{}
+	if err = mac.UnmarshalBinary(macBytes); err != nil {
+		return nil, err
+	}
+
+	return mac, nil
+}
+
+// dialLnd establishes a connection to dcrlnd's RPC server authenticated with
+// the given macaroon. Any extra options are added to the default ones.
+func dialLnd(lndNode, tlsCertPath string, mac *macaroon.Macaroon,
+	extraOpts ...grpc.DialOption) (*grpc.ClientConn, error) {
+
+	creds, err := credentials.NewClientTLSFromFile(tlsCertPath, "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cert file: %v", err)
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithPerRPCCredentials(macaroons.NewMacaroonCredential(mac)),
+	}
+	opts = append(opts, extraOpts...)
+
+	conn, err := grpc.Dial(lndNode, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial to lnd's gRPC server: %v", err)
+	}
+
+	return conn, nil
+}
+
+// forEachProtoField calls f for every field of the protobuf encoded message.
+// Only varint and length delimited fields are supported, which is all that
+// is needed to decode macaroon IDs. The value of varint fields is passed as
+// nil.
+func forEachProtoField(msg []byte, f func(num uint64, val []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errUnknownMacaroonFormat
+		}
+		msg = msg[n:]
+
+		var val []byte
+		switch key & 7 {
+		// Varint.
+		case 0:
+			_, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errUnknownMacaroonFormat
+			}
+			msg = msg[n:]
+
+		// Length delimited.
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || length > uint64(len(msg)-n) {
+				return errUnknownMacaroonFormat
+			}
+			val = msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+
+		default:
+			return errUnknownMacaroonFormat
+		}
+
+		if err := f(key>>3, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// macaroonOps decodes the permissions granted by a macaroon baked by dcrlnd.
+// These are encoded in the macaroon ID as a version byte followed by a
+// protobuf message with the operations in field 3, each of which holds an
+// entity in field 1 and its actions in field 2.
+func macaroonOps(mac *macaroon.Macaroon) ([]macaroonOp, error) {
+	id := mac.Id()
+	if len(id) == 0 || id[0] != macaroonIDVersion {
+		return nil, errUnknownMacaroonFormat
+	}
+
+	var ops []macaroonOp
+	err := forEachProtoField(id[1:], func(num uint64, val []byte) error {
+		if num != 3 {
+			return nil
+		}
+
+		var op macaroonOp
+		err := forEachProtoField(val, func(num uint64, val []byte) error {
+			switch num {
+			case 1:
+				op.entity = string(val)
+			case 2:
+				op.actions = append(op.actions, string(val))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		ops = append(ops, op)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ops, nil
+}
+
+// hasAnyPermission returns whether any of the permissions in want is granted
+// by ops.
+func hasAnyPermission(ops, want []macaroonOp) bool {
+	for _, op := range ops {
+		for _, w := range want {
+			if op.entity != w.entity {
+				continue
+			}
+			for _, action := range op.actions {
+				for _, wantAction := range w.actions {
+					if action == wantAction {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// checkMacaroonPermissions refuses macaroons that allow moving the funds of
+// the node, such as the admin macaroon, unless allowAdmin is set. Macaroons
+// whose permissions can't be determined are refused as well.
+func checkMacaroonPermissions(mac *macaroon.Macaroon, allowAdmin bool) error {
+	if allowAdmin {
+		return nil
+	}
+
+	ops, err := macaroonOps(mac)
+	if err != nil {
+		return fmt.Errorf("unable to determine the permissions of the "+
+			"macaroon (%v), use an invoice macaroon or set "+
+			"--allow_admin_macaroon", err)
+	}
+
+	if hasAnyPermission(ops, fundsPermissions) {
+		return errors.New("the macaroon allows moving the funds of " +
+			"the node, use an invoice macaroon or set " +
+			"--allow_admin_macaroon")
+	}
+
+	return nil
+}
+
+// macaroonPermission mirrors lnrpc.MacaroonPermission, which isn't available
+// in the version of dcrlnd the faucet is built against.
+type macaroonPermission struct {
+	Entity string `protobuf:"bytes,1,opt,name=entity,proto3" json:"entity,omitempty"`
+	Action string `protobuf:"bytes,2,opt,name=action,proto3" json:"action,omitempty"`
+}
+
+func (m *macaroonPermission) Reset()         { *m = macaroonPermission{} }
+func (m *macaroonPermission) String() string { return fmt.Sprintf("%+v", *m) }
+func (*macaroonPermission) ProtoMessage()    {}
+
+// bakeMacaroonRequest mirrors lnrpc.BakeMacaroonRequest.
+type bakeMacaroonRequest struct {
+	Permissions []*macaroonPermission `protobuf:"bytes,1,rep,name=permissions,proto3" json:"permissions,omitempty"`
+}
+
+func (m *bakeMacaroonRequest) Reset()         { *m = bakeMacaroonRequest{} }
+func (m *bakeMacaroonRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*bakeMacaroonRequest) ProtoMessage()    {}
+
+// bakeMacaroonResponse mirrors lnrpc.BakeMacaroonResponse.
+type bakeMacaroonResponse struct {
+	Macaroon string `protobuf:"bytes,1,opt,name=macaroon,proto3" json:"macaroon,omitempty"`
+}
+
+func (m *bakeMacaroonResponse) Reset()         { *m = bakeMacaroonResponse{} }
+func (m *bakeMacaroonResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*bakeMacaroonResponse) ProtoMessage()    {}
+
+// requiredPermissions returns the permissions the faucet needs with the given
+// configuration: those of tippinPermissions, plus those of the optional
+// features which are enabled.
+func requiredPermissions(cfg *config) []macaroonOp {
+	ops := append([]macaroonOp(nil), tippinPermissions...)
+	if cfg.InvoiceFallbackAddr {
+		ops = append(ops, fallbackAddrPermissions...)
+	}
+	if cfg.CheckLiquidity {
+		ops = append(ops, listChannelsPermissions...)
+	}
+
+	return ops
+}
+
+// bakeMacaroon asks dcrlnd to bake a macaroon restricted to the permissions
+// needed by the faucet with the given configuration and stores it at
+// outPath. The admin macaroon of the configured network is used to
+// authenticate the request, since baking macaroons requires the
+// macaroon:generate permission.
+func bakeMacaroon(cfg *config, outPath string) error {
+	adminMacPath := filepath.Join(
+		cfg.LndDir, "data", "chain", "decred", cfg.network,
+		adminMacaroonFilename,
+	)
+	mac, err := loadMacaroon(adminMacPath)
+	if err != nil {
+		return fmt.Errorf("unable to load admin macaroon: %v", err)
+	}
+
+	conn, err := dialLnd(cfg.LndNode, cfg.TLSCertPath, mac)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := &bakeMacaroonRequest{}
+	for _, op := range requiredPermissions(cfg) {
+		for _, action := range op.actions {
+			req.Permissions = append(req.Permissions,
+				&macaroonPermission{
+					Entity: op.entity,
+					Action: action,
+				})
+		}
+	}
+
+	resp := &bakeMacaroonResponse{}
+	err = conn.Invoke(
+		context.Background(), bakeMacaroonMethod, req, resp,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to bake macaroon (dcrlnd may be too "+
+			"old to support BakeMacaroon): %v", err)
+	}
+
+	macBytes, err := hex.DecodeString(resp.Macaroon)
+	if err != nil {
+		return fmt.Errorf("invalid macaroon returned by dcrlnd: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outPath), 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(outPath, macBytes, 0600)
+}
+
+// checkWithdrawalPermissions refuses macaroons which don't allow paying
+// invoices. Macaroons whose permissions can't be determined, such as the admin
+// macaroon of older nodes, are assumed to allow it.
+func checkWithdrawalPermissions(mac *macaroon.Macaroon) error {
+	ops, err := macaroonOps(mac)
+	if err != nil {
+		log.Warnf("Unable to determine whether the macaroon allows "+
+			"paying invoices: %v", err)
+		return nil
+	}
+
+	if !hasAnyPermission(ops, withdrawalPermissions) {
+		return errors.New("the macaroon doesn't allow paying invoices, " +
+			"use a macaroon with the offchain:write permission")
+	}
+
+	return nil
+}
+
+// checkChannelPermissions returns an error if the macaroon is known not to
+// allow opening channels. Macaroons whose permissions can't be determined are
+// accepted, as dcrlnd has the final say.
+func checkChannelPermissions(mac *macaroon.Macaroon) error {
+	ops, err := macaroonOps(mac)
+	if err != nil {
+		log.Warnf("Unable to determine whether the macaroon allows "+
+			"opening channels: %v", err)
+		return nil
+	}
+
+	for _, want := range channelPermissions {
+		for _, action := range want.actions {
+			op := macaroonOp{
+				entity:  want.entity,
+				actions: []string{action},
+			}
+			if hasAnyPermission(ops, []macaroonOp{op}) {
+				continue
+			}
+
+			return fmt.Errorf("the macaroon doesn't allow opening "+
+				"channels, use a macaroon with the %s:%s "+
+				"permission", want.entity, action)
+		}
+	}
+
+	return nil
+}
+
+// canGetInfo reports whether the macaroon allows getting the identity and
+// sync state of the node, which the invoice macaroon doesn't. Macaroons whose
+// permissions can't be determined are assumed to allow it, as dcrlnd has the
+// final say.
+func canGetInfo(mac *macaroon.Macaroon) bool {
+	ops, err := macaroonOps(mac)
+	if err != nil {
+		return true
+	}
+
+	return hasAnyPermission(ops, nodeInfoPermissions)
+}
+
+// canListChannels reports whether the macaroon allows listing the channels of
+// the node, which the invoice macaroon doesn't. Macaroons whose permissions
+// can't be determined are assumed to allow it, as dcrlnd has the final say.
+func canListChannels(mac *macaroon.Macaroon) bool {
+	ops, err := macaroonOps(mac)
+	if err != nil {
+		return true
+	}
+
+	return hasAnyPermission(ops, listChannelsPermissions)
+}
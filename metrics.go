@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The metrics are exported in the Prometheus text exposition format, which
+// is simple enough to be produced directly instead of pulling in the
+// Prometheus client library and its dependencies.
+
+var (
+	// latencyBuckets are the upper bounds in seconds of the buckets of the
+	// latency histograms.
+	latencyBuckets = []float64{
+		.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+	}
+
+	invoicesCreated = newCounterVec(
+		"dcrtippin_invoices_created_total",
+		"Number of invoices created.",
+	)
+	invoicesSettled = newCounterVec(
+		"dcrtippin_invoices_settled_total",
+		"Number of invoices settled.",
+	)
+	atomsTipped = newCounterVec(
+		"dcrtippin_tipped_atoms_total",
+		"Amount received by settled invoices in atoms.",
+	)
+	openAmountViolations = newCounterVec(
+		"dcrtippin_open_amount_violations_total",
+		"Number of open-amount tips paid outside the amount limits, "+
+			"by violation.", "violation",
+	)
+	invoiceErrors = newCounterVec(
+		"dcrtippin_invoice_errors_total",
+		"Number of invoice requests that failed, by error.", "error",
+	)
+	rateLimited = newCounterVec(
+		"dcrtippin_ratelimit_rejections_total",
+		"Number of invoice requests rejected by the rate limiter.",
+	)
+	channelsOpened = newCounterVec(
+		"dcrtippin_channels_opened_total",
+		"Number of channels opened to visitors.",
+	)
+	channelsClosed = newCounterVec(
+		"dcrtippin_channels_closed_total",
+		"Number of channels closed by the reaper, by reason.",
+		"reason",
+	)
+	webhookDeliveries = newCounterVec(
+		"dcrtippin_webhook_deliveries_total",
+		"Number of attempts to deliver webhooks, by endpoint and "+
+			"outcome.", "endpoint", "outcome",
+	)
+	eventStreamsOpened = newCounterVec(
+		"dcrtippin_event_streams_total",
+		"Number of invoice status streams opened, by transport.",
+		"transport",
+	)
+	lndLatency = newHistogramVec(
+		"dcrtippin_lnd_request_duration_seconds",
+		"Latency of the requests to dcrlnd, by method.", "method",
+	)
+	httpDuration = newHistogramVec(
+		"dcrtippin_http_request_duration_seconds",
+		"Duration of the HTTP requests, by route and status code.",
+		"route", "code",
+	)
+)
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels formats the label pairs of a sample, including the optional
+// extra pair.
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// counterVec is a set of counters partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mtx    sync.Mutex
+	values map[string]float64
+	order  map[string][]string
+}
+
+// newCounterVec creates a counter partitioned by the given labels.
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		order:  make(map[string][]string),
+	}
+}
+
+// add increases the counter identified by the label values by delta.
+func (c *counterVec) add(delta float64, labelValues ...string) {
+	key := labelKey(labelValues)
+
+	c.mtx.Lock()
+	c.values[key] += delta
+	c.order[key] = labelValues
+	c.mtx.Unlock()
+}
+
+// inc increments the counter identified by the label values.
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+// write writes the counters in the text exposition format.
+func (c *counterVec) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help,
+		c.name)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// Unlabeled counters are always exported, even before they're first
+	// incremented.
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name,
+			formatLabels(c.labels, c.order[key]),
+			formatFloat(c.values[key]))
+	}
+}
+
+// histogram is a single histogram of observations.
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// histogramVec is a set of histograms partitioned by label values, all
+// sharing latencyBuckets.
+type histogramVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mtx        sync.Mutex
+	histograms map[string]*histogram
+}
+
+// newHistogramVec creates a histogram partitioned by the given labels.
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labels:     labels,
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// observe records the duration in the histogram identified by the label
+// values.
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	key := labelKey(labelValues)
+	seconds := d.Seconds()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(latencyBuckets)),
+		}
+		h.histograms[key] = hist
+	}
+
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += seconds
+}
+
+// write writes the histograms in the text exposition format.
+func (h *histogramVec) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help,
+		h.name)
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.histograms[key]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labels, hist.labelValues, "le",
+					formatFloat(bound)),
+				hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(h.labels, hist.labelValues, "le", "+Inf"),
+			hist.count)
+
+		labels := formatLabels(h.labels, hist.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels,
+			formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hist.count)
+	}
+}
+
+// formatFloat formats a sample value.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of the map in order, so the output is stable.
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// recordInvoiceOutcome counts the outcome of an invoice request.
+func recordInvoiceOutcome(c chanCreationError) {
+	if c == NoError {
+		invoicesCreated.inc()
+		return
+	}
+
+	invoiceErrors.inc(c.Code())
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before writing it.
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes through to the underlying writer, if supported.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes hijacking through to the underlying writer, as required to
+// upgrade to WebSocket connections.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// instrumentHandler is a middleware recording the duration of the requests
+// by the path template of their route, so the number of distinct routes is
+// bounded regardless of the requested paths.
+func instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		httpDuration.observe(
+			time.Since(start), route, strconv.Itoa(rec.status),
+		)
+	})
+}
+
+// healthz reports that the process is up.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports whether the faucet is able to generate invoices, that is
+// dcrlnd can be reached and is synced to the chain. The sync state is only
+// checked when the macaroon allows getting node info.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch {
+	case l.breaker.isOpen():
+		http.Error(w, "node unavailable", http.StatusServiceUnavailable)
+	case l.nodeInfo.notSynced():
+		http.Error(w, "node not synced", http.StatusServiceUnavailable)
+	// The sync state is unknown until GetInfo first succeeds.
+	case l.nodeInfo != nil && l.nodeInfo.snapshot() == nil:
+		http.Error(w, "node info unavailable",
+			http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// metrics exports the metrics of the faucet in the Prometheus text
+// exposition format.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+
+	buf := bufio.NewWriter(w)
+	invoicesCreated.write(buf)
+	invoicesSettled.write(buf)
+
+	// Invoices expire without any notification from dcrlnd, so the
+	// expired ones are counted by the tracker as it evicts them.
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+		"dcrtippin_invoices_expired_total",
+		"Number of tracked invoices that expired unpaid.",
+		"dcrtippin_invoices_expired_total",
+		"dcrtippin_invoices_expired_total",
+		l.invoices.numExpired())
+
+	atomsTipped.write(buf)
+	invoiceErrors.write(buf)
+	rateLimited.write(buf)
+	channelsOpened.write(buf)
+	channelsClosed.write(buf)
+	webhookDeliveries.write(buf)
+	eventStreamsOpened.write(buf)
+	lndLatency.write(buf)
+	httpDuration.write(buf)
+
+	// The inbound capacity is only exported once it's known.
+	if capacity, _ := l.liquidity.snapshot(); capacity != nil {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+			"dcrtippin_max_receivable_atoms",
+			"Largest payment the node can currently receive.",
+			"dcrtippin_max_receivable_atoms",
+			"dcrtippin_max_receivable_atoms",
+			int64(capacity.MaxReceivable))
+	}
+
+	if err := buf.Flush(); err != nil {
+		log.Debugf("Unable to write metrics: %v", err)
+	}
+}
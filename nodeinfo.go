@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrlnd/lnrpc"
+)
+
+// nodeInfo is a snapshot of the identity and sync state of the node, as
+// reported by GetInfo.
+type nodeInfo struct {
+	Pubkey            string
+	Alias             string
+	URIs              []string
+	Version           string
+	GitCommitHash     string
+	BlockHeight       uint32
+	SyncedToChain     bool
+	NumActiveChannels uint32
+	NumPeers          uint32
+
+	// Updated is the time the snapshot was taken.
+	Updated time.Time
+}
+
+// nodeAddr returns the address where the node can be reached, falling back
+// to its pubkey when the node doesn't advertise any URI.
+func (n *nodeInfo) nodeAddr() string {
+	if len(n.URIs) > 0 {
+		return n.URIs[0]
+	}
+
+	return n.Pubkey
+}
+
+// newNodeInfo converts a GetInfo response into a snapshot.
+func newNodeInfo(info *lnrpc.GetInfoResponse) *nodeInfo {
+	n := &nodeInfo{
+		Pubkey:            info.IdentityPubkey,
+		Alias:             info.Alias,
+		URIs:              info.Uris,
+		Version:           info.Version,
+		BlockHeight:       info.BlockHeight,
+		SyncedToChain:     info.SyncedToChain,
+		NumActiveChannels: info.NumActiveChannels,
+		NumPeers:          info.NumPeers,
+		Updated:           time.Now(),
+	}
+
+	// The version reported by dcrlnd carries the commit it was built
+	// from as "<version> commit=<commit>".
+	if i := strings.Index(info.Version, "commit="); i >= 0 {
+		n.GitCommitHash = strings.TrimPrefix(
+			info.Version[i:], "commit=",
+		)
+	}
+
+	return n
+}
+
+// nodeInfoMonitor periodically queries GetInfo, keeping a snapshot of the
+// node's state which can be safely read concurrently.
+type nodeInfoMonitor struct {
+	lnd      lnrpc.LightningClient
+	interval time.Duration
+
+	mtx  sync.RWMutex
+	info *nodeInfo
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newNodeInfoMonitor creates a monitor refreshing the node info every
+// interval.
+func newNodeInfoMonitor(lnd lnrpc.LightningClient,
+	interval time.Duration) *nodeInfoMonitor {
+
+	return &nodeInfoMonitor{
+		lnd:      lnd,
+		interval: interval,
+	}
+}
+
+// Start fetches the node info and launches the goroutine which keeps it up
+// to date until ctx is canceled or the monitor is stopped.
+func (m *nodeInfoMonitor) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+
+	m.refresh(ctx)
+
+	m.wg.Add(1)
+	go m.poll(ctx)
+}
+
+// Stop terminates the monitor and waits for it to exit.
+func (m *nodeInfoMonitor) Stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// poll refreshes the node info every interval until ctx is canceled.
+//
+// NOTE: This MUST be run as a goroutine.
+func (m *nodeInfoMonitor) poll(ctx context.Context) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.refresh(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh queries GetInfo and stores the result. On failure the previous
+// snapshot is kept.
+func (m *nodeInfoMonitor) refresh(ctx context.Context) {
+	resp, err := m.lnd.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warnf("Unable to get node info: %v", err)
+		}
+		return
+	}
+	info := newNodeInfo(resp)
+
+	m.mtx.Lock()
+	prev := m.info
+	m.info = info
+	m.mtx.Unlock()
+
+	switch {
+	case prev == nil:
+		log.Infof("Connected to node %s (%s) version %s at height %d",
+			info.Pubkey, info.Alias, info.Version, info.BlockHeight)
+	case prev.SyncedToChain && !info.SyncedToChain:
+		log.Warnf("Node is no longer synced to the chain")
+	case !prev.SyncedToChain && info.SyncedToChain:
+		log.Infof("Node synced to the chain at height %d",
+			info.BlockHeight)
+	}
+}
+
+// snapshot returns the most recent node info, or nil if GetInfo hasn't
+// succeeded yet or if the monitor itself is nil because the macaroon doesn't
+// allow getting node info. The returned value must not be modified.
+func (m *nodeInfoMonitor) snapshot() *nodeInfo {
+	if m == nil {
+		return nil
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.info
+}
+
+// notSynced reports whether the node is known to be catching up with the
+// chain. An unknown state isn't considered as not synced, so tips are still
+// accepted while GetInfo fails or when the macaroon doesn't allow it.
+func (m *nodeInfoMonitor) notSynced() bool {
+	info := m.snapshot()
+	return info != nil && !info.SyncedToChain
+}
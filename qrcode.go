@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// qrCodePNGSize is the width and height in pixels of the PNG QR codes.
+	qrCodePNGSize = 256
+
+	// qrCodeCacheControl is the Cache-Control header of the QR codes. A
+	// payment request never changes, so its QR code can be cached for as
+	// long as the invoice may be paid.
+	qrCodeCacheControl = "public, max-age=3600"
+)
+
+// paymentRequestURI returns the URI encoded in the QR code of a payment
+// request. BOLT-11 payment requests are case insensitive, so the URI is
+// uppercased which allows the denser alphanumeric QR encoding to be used.
+func paymentRequestURI(payReq string) string {
+	return strings.ToUpper("lightning:" + payReq)
+}
+
+// qrCodeSVG renders the QR code as an SVG image, drawing every dark module
+// as a unit square of a single path.
+func qrCodeSVG(qr *qrcode.QRCode) []byte {
+	bitmap := qr.Bitmap()
+
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" `+
+		`viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		len(bitmap), len(bitmap))
+	svg.WriteString(`<rect width="100%" height="100%" fill="#ffffff"/>`)
+	fmt.Fprintf(&svg, `<path fill="#000000" d="%s"/></svg>`, path.String())
+
+	return svg.Bytes()
+}
+
+// invoiceQRCode renders the payment request of the invoice identified by the
+// payment hash in the URL as a QR code, either in the PNG or SVG format.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) invoiceQRCode(w http.ResponseWriter, r *http.Request) {
+	homeState, ok := l.invoicePageContext(w, r)
+	if !ok {
+		return
+	}
+
+	qr, err := qrcode.New(
+		paymentRequestURI(homeState.InvoicePaymentRequest),
+		qrcode.Medium,
+	)
+	if err != nil {
+		log.Errorf("unable to encode QR code: %v", err)
+		http.Error(w, "unable to encode QR code",
+			http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		contentType string
+		img         []byte
+	)
+	switch mux.Vars(r)["format"] {
+	case "png":
+		contentType = "image/png"
+		img, err = qr.PNG(qrCodePNGSize)
+		if err != nil {
+			log.Errorf("unable to render QR code: %v", err)
+			http.Error(w, "unable to render QR code",
+				http.StatusInternalServerError)
+			return
+		}
+
+	case "svg":
+		contentType = "image/svg+xml"
+		img = qrCodeSVG(qr)
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", qrCodeCacheControl)
+	w.Write(img)
+}
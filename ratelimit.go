@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a rate limiting bucket which holds up to burst tokens and
+// earns a new token every interval.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the bucket was last updated.
+func (b *tokenBucket) refill(now time.Time, burst int,
+	interval time.Duration) {
+
+	elapsed := now.Sub(b.last)
+	if elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(interval)
+		b.tokens = math.Min(b.tokens, float64(burst))
+		b.last = now
+	}
+}
+
+// wait returns how long until the bucket holds a whole token.
+func (b *tokenBucket) wait(interval time.Duration) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) * float64(interval))
+}
+
+// rateLimiter limits the rate at which invoices are requested. Every client
+// gets its own token bucket keyed by its IP address, and all clients combined
+// are additionally bound by a global bucket so a large number of clients
+// can't flood the node.
+type rateLimiter struct {
+	burst    int
+	interval time.Duration
+
+	// globalBurst and globalInterval configure the bucket shared by all
+	// clients. A globalBurst of zero disables the global limit.
+	globalBurst    int
+	globalInterval time.Duration
+
+	// trustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For header is used to determine the client address.
+	trustedProxies []*net.IPNet
+
+	mtx       sync.Mutex
+	buckets   map[string]*tokenBucket
+	global    tokenBucket
+	lastSweep time.Time
+
+	// globalLimited indicates the global bucket was exhausted, so the
+	// limit is only logged once until it's lifted.
+	globalLimited bool
+}
+
+// newRateLimiter creates a rate limiter which allows each client burst
+// requests, earning an additional one every interval. trustedProxies lists
+// the IPs or CIDRs of the proxies whose X-Forwarded-For header is trusted.
+func newRateLimiter(burst int, interval time.Duration, globalBurst int,
+	globalInterval time.Duration, trustedProxies []string) (*rateLimiter, error) {
+
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &rateLimiter{
+		burst:          burst,
+		interval:       interval,
+		globalBurst:    globalBurst,
+		globalInterval: globalInterval,
+		trustedProxies: proxies,
+		buckets:        make(map[string]*tokenBucket),
+		global: tokenBucket{
+			tokens: float64(globalBurst),
+			last:   now,
+		},
+		lastSweep: now,
+	}, nil
+}
+
+// rate returns the burst and interval of the bucket of each client.
+func (r *rateLimiter) rate() (int, time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.burst, r.interval
+}
+
+// setRate changes the burst and interval of the bucket of each client. The
+// tokens already earned by the clients are kept, up to the new burst.
+func (r *rateLimiter) setRate(burst int, interval time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.burst = burst
+	r.interval = interval
+}
+
+// parseTrustedProxies parses a list of IP addresses or CIDRs.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q",
+					proxy)
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxy = fmt.Sprintf("%s/%d", ip, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v",
+				proxy, err)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// isTrustedProxy returns whether ip belongs to one of the trusted proxies.
+func (r *rateLimiter) isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range r.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns the IP address of the client that issued the request.
+// The X-Forwarded-For header is only taken into account when the request
+// was received from a trusted proxy, in which case the right-most address
+// not belonging to a trusted proxy is the client.
+func (r *rateLimiter) clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !r.isTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(
+		strings.Join(req.Header["X-Forwarded-For"], ","), ",",
+	)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			// A malformed entry can't be attributed to anyone,
+			// so stop at the last address we trust.
+			break
+		}
+
+		ip = hop
+		if !r.isTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// clientKey returns the key of the bucket used for the client. IPv6 clients
+// usually control a whole /64, so they are grouped by that prefix.
+func clientKey(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return ip.To4().String()
+	default:
+		return ip.Mask(net.CIDRMask(64, 8*net.IPv6len)).String()
+	}
+}
+
+// allow consumes a token for the client that issued the request. If either
+// the client or the global bucket is exhausted, false is returned along with
+// the time the client should wait before retrying.
+func (r *rateLimiter) allow(req *http.Request) (bool, time.Duration) {
+	key := clientKey(r.clientIP(req))
+	now := time.Now()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.sweep(now)
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(r.burst), last: now}
+		r.buckets[key] = bucket
+	}
+	bucket.refill(now, r.burst, r.interval)
+	if wait := bucket.wait(r.interval); wait > 0 {
+		return false, wait
+	}
+
+	if r.globalBurst > 0 {
+		r.global.refill(now, r.globalBurst, r.globalInterval)
+		if wait := r.global.wait(r.globalInterval); wait > 0 {
+			if !r.globalLimited {
+				log.Warnf("Global invoice rate limit reached")
+				r.globalLimited = true
+			}
+			return false, wait
+		}
+		if r.globalLimited {
+			log.Infof("Global invoice rate limit lifted")
+			r.globalLimited = false
+		}
+		r.global.tokens--
+	}
+	bucket.tokens--
+
+	return true, 0
+}
+
+// sweep removes the buckets of clients that have been idle long enough to
+// be completely refilled, as those are equivalent to a new bucket. The
+// caller must hold the mutex.
+func (r *rateLimiter) sweep(now time.Time) {
+	fullAfter := time.Duration(r.burst) * r.interval
+	if now.Sub(r.lastSweep) < fullAfter {
+		return
+	}
+
+	for key, bucket := range r.buckets {
+		if now.Sub(bucket.last) >= fullAfter {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+// retryAfterSeconds formats a wait duration for the Retry-After header.
+func retryAfterSeconds(wait time.Duration) string {
+	return fmt.Sprintf("%d", int64(math.Ceil(wait.Seconds())))
+}
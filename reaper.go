@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrlnd/lnrpc"
+)
+
+// closeReason is why the reaper closed a channel.
+type closeReason string
+
+const (
+	// closeReasonAge indicates the channel reached the maximum age.
+	closeReasonAge closeReason = "age"
+
+	// closeReasonInactive indicates the remote node was offline for too
+	// long.
+	closeReasonInactive closeReason = "inactive"
+
+	// closeReasonOverCap indicates the faucet had more channels than
+	// allowed, and the channel was among the oldest.
+	closeReasonOverCap closeReason = "over_cap"
+)
+
+// reaperConfig are the rules by which the reaper closes channels.
+type reaperConfig struct {
+	// interval is how often the channels are checked.
+	interval time.Duration
+
+	// maxChannels is the number of channels the faucet keeps open, the
+	// oldest channels above it are closed.
+	maxChannels int
+
+	// maxAge is the number of blocks after which a channel is closed, 0
+	// for no limit.
+	maxAge uint32
+
+	// inactiveTimeout is how long the remote node may stay offline
+	// before its channel is closed, 0 for no limit.
+	inactiveTimeout time.Duration
+
+	// forceCloseGrace is how long cooperative closes are attempted before
+	// the channel is force closed, 0 to never force close.
+	forceCloseGrace time.Duration
+
+	// closeTimeout is how long to wait for dcrlnd to report the closing
+	// transaction of a channel.
+	closeTimeout time.Duration
+}
+
+// channelReaper periodically closes the channels opened by the faucet which
+// are too old, whose remote node went away, or which exceed the number of
+// channels the faucet keeps open. Channels are closed cooperatively, and only
+// force closed once cooperative closes failed for the grace period.
+type channelReaper struct {
+	lnd      lnrpc.LightningClient
+	nodeInfo *nodeInfoMonitor
+	store    *tipStore
+	cfg      reaperConfig
+
+	// inactiveSince is when each inactive channel, keyed by channel
+	// point, was first seen inactive, and closingSince when the reaper
+	// first tried to close each channel. They're only accessed by the
+	// reaper goroutine.
+	inactiveSince map[string]time.Time
+	closingSince  map[string]time.Time
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newChannelReaper creates a reaper closing channels according to cfg. The
+// height of the chain is taken from nodeInfo, and the closures are recorded
+// in store.
+func newChannelReaper(lnd lnrpc.LightningClient, nodeInfo *nodeInfoMonitor,
+	store *tipStore, cfg reaperConfig) *channelReaper {
+
+	return &channelReaper{
+		lnd:           lnd,
+		nodeInfo:      nodeInfo,
+		store:         store,
+		cfg:           cfg,
+		inactiveSince: make(map[string]time.Time),
+		closingSince:  make(map[string]time.Time),
+	}
+}
+
+// Start launches the goroutine which closes the channels until ctx is
+// canceled or the reaper is stopped.
+func (r *channelReaper) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+
+	r.wg.Add(1)
+	go r.run(ctx)
+}
+
+// Stop terminates the reaper and waits for it to exit.
+func (r *channelReaper) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// run checks the channels every interval until ctx is canceled.
+//
+// NOTE: This MUST be run as a goroutine.
+func (r *channelReaper) run(ctx context.Context) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.reap(ctx, time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fundingHeight returns the height of the block which confirmed the funding
+// transaction of the channel, which makes up the upper 3 bytes of its short
+// channel ID.
+func fundingHeight(chanID uint64) uint32 {
+	return uint32(chanID >> 40)
+}
+
+// channelAge returns the number of blocks mined on top of the one which
+// confirmed the funding transaction of the channel.
+func channelAge(height uint32, chanID uint64) uint32 {
+	// The snapshot of the node info may be older than the channel.
+	if fundingHeight(chanID) > height {
+		return 0
+	}
+
+	return height - fundingHeight(chanID)
+}
+
+// reap closes the channels which should no longer be kept open.
+func (r *channelReaper) reap(ctx context.Context, now time.Time) {
+	// The age of the channels is only known once the node is synced.
+	info := r.nodeInfo.snapshot()
+	if info == nil || !info.SyncedToChain {
+		chanLog.Debugf("Not closing channels until the node is synced")
+		return
+	}
+
+	resp, err := r.lnd.ListChannels(ctx, &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		if ctx.Err() == nil {
+			chanLog.Errorf("Unable to list channels: %v", err)
+		}
+		return
+	}
+
+	// Only the channels opened by the faucet are closed, not those other
+	// nodes opened to it.
+	var channels []*lnrpc.Channel
+	listed := make(map[string]struct{})
+	for _, channel := range resp.Channels {
+		listed[channel.ChannelPoint] = struct{}{}
+		if !channel.Initiator {
+			continue
+		}
+		channels = append(channels, channel)
+
+		if channel.Active {
+			delete(r.inactiveSince, channel.ChannelPoint)
+		} else if _, ok := r.inactiveSince[channel.ChannelPoint]; !ok {
+			r.inactiveSince[channel.ChannelPoint] = now
+		}
+	}
+
+	// Channels which are no longer open were closed, either by the
+	// reaper or otherwise.
+	for chanPoint := range r.inactiveSince {
+		if _, ok := listed[chanPoint]; !ok {
+			delete(r.inactiveSince, chanPoint)
+		}
+	}
+	for chanPoint := range r.closingSince {
+		if _, ok := listed[chanPoint]; !ok {
+			delete(r.closingSince, chanPoint)
+		}
+	}
+
+	// The oldest channels come first, so they're the ones closed when
+	// the faucet has too many.
+	sort.SliceStable(channels, func(i, j int) bool {
+		return channels[i].ChanId < channels[j].ChanId
+	})
+
+	reasons := make(map[string]closeReason)
+	for _, channel := range channels {
+		age := channelAge(info.BlockHeight, channel.ChanId)
+		inactiveSince, inactive := r.inactiveSince[channel.ChannelPoint]
+
+		switch {
+		case r.cfg.maxAge > 0 && age >= r.cfg.maxAge:
+			reasons[channel.ChannelPoint] = closeReasonAge
+
+		case r.cfg.inactiveTimeout > 0 && inactive &&
+			now.Sub(inactiveSince) >= r.cfg.inactiveTimeout:
+
+			reasons[channel.ChannelPoint] = closeReasonInactive
+		}
+	}
+
+	excess := len(channels) - len(reasons) - r.cfg.maxChannels
+	for _, channel := range channels {
+		if excess <= 0 {
+			break
+		}
+		if _, ok := reasons[channel.ChannelPoint]; ok {
+			continue
+		}
+
+		reasons[channel.ChannelPoint] = closeReasonOverCap
+		excess--
+	}
+
+	for _, channel := range channels {
+		reason, ok := reasons[channel.ChannelPoint]
+		if !ok {
+			continue
+		}
+
+		age := channelAge(info.BlockHeight, channel.ChanId)
+		if err := r.closeChannel(ctx, now, channel, age, reason); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			chanLog.Warnf("Unable to close channel %s to %s (%s): %v",
+				channel.ChannelPoint, channel.RemotePubkey, reason,
+				err)
+		}
+	}
+}
+
+// parseChannelPoint parses a channel point formatted as txid:index.
+func parseChannelPoint(chanPoint string) (*lnrpc.ChannelPoint, error) {
+	i := strings.LastIndex(chanPoint, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid channel point %q", chanPoint)
+	}
+
+	txid, err := chainhash.NewHashFromStr(chanPoint[:i])
+	if err != nil {
+		return nil, err
+	}
+	index, err := strconv.ParseUint(chanPoint[i+1:], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel point %q", chanPoint)
+	}
+
+	return &lnrpc.ChannelPoint{
+		FundingTxid: &lnrpc.ChannelPoint_FundingTxidStr{
+			FundingTxidStr: txid.String(),
+		},
+		OutputIndex: uint32(index),
+	}, nil
+}
+
+// closeChannel closes the channel, force closing it if cooperative closes
+// failed for longer than the grace period, and records the closure. It
+// returns once the closing transaction is broadcast.
+func (r *channelReaper) closeChannel(ctx context.Context, now time.Time,
+	channel *lnrpc.Channel, age uint32, reason closeReason) error {
+
+	chanPoint, err := parseChannelPoint(channel.ChannelPoint)
+	if err != nil {
+		return err
+	}
+
+	closingSince, ok := r.closingSince[channel.ChannelPoint]
+	if !ok {
+		closingSince = now
+		r.closingSince[channel.ChannelPoint] = now
+	}
+	force := r.cfg.forceCloseGrace > 0 &&
+		now.Sub(closingSince) >= r.cfg.forceCloseGrace
+
+	// Only the first update, which reports the closing transaction, is
+	// waited for. Canceling the stream afterwards doesn't abort the
+	// closure. Streams aren't given a deadline by the client, so the
+	// update is only waited for up to the close timeout.
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.closeTimeout)
+	defer cancel()
+
+	stream, err := r.lnd.CloseChannel(ctx, &lnrpc.CloseChannelRequest{
+		ChannelPoint: chanPoint,
+		Force:        force,
+	})
+	if err != nil {
+		return err
+	}
+	update, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	var closingTxid []byte
+	switch {
+	case update.GetClosePending() != nil:
+		closingTxid = update.GetClosePending().Txid
+	case update.GetChanClose() != nil:
+		closingTxid = update.GetChanClose().ClosingTxid
+	default:
+		return errors.New("no closing transaction reported")
+	}
+	txid, err := chainhash.NewHash(closingTxid)
+	if err != nil {
+		return err
+	}
+
+	delete(r.closingSince, channel.ChannelPoint)
+	delete(r.inactiveSince, channel.ChannelPoint)
+
+	channelsClosed.inc(string(reason))
+	chanLog.Infof("Closed channel %s to %s (%s, %d blocks old, force=%v) "+
+		"in %s", channel.ChannelPoint, channel.RemotePubkey, reason, age,
+		force, txid)
+
+	err = r.store.putClosure(&channelClosure{
+		ChannelPoint:  channel.ChannelPoint,
+		RemotePubkey:  channel.RemotePubkey,
+		Capacity:      channel.Capacity,
+		FundingHeight: fundingHeight(channel.ChanId),
+		AgeBlocks:     age,
+		Reason:        reason,
+		Force:         force,
+		ClosingTxid:   txid.String(),
+		ClosedAt:      now,
+	})
+	if err != nil {
+		// The channel is closing anyway, so there's no point in
+		// trying again.
+		chanLog.Errorf("Unable to record closure of channel %s: %v",
+			channel.ChannelPoint, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/decred/dcrd/dcrutil"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// recipientSlugPattern matches the valid recipient slugs.
+	recipientSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+)
+
+// recipient is a person receiving tips through the faucet on their own page.
+// The tips of all recipients are received by the same node, the ledger
+// attributes each tip to its recipient.
+type recipient struct {
+	// Slug identifies the recipient in the URLs of their pages.
+	Slug string `json:"slug"`
+
+	// Name is the name displayed on the pages of the recipient.
+	Name string `json:"name"`
+
+	// Avatar is the URL of the picture of the recipient, either absolute
+	// or a path on the faucet such as /static/images/alice.png.
+	Avatar string `json:"avatar"`
+
+	// Description is displayed below the name of the recipient.
+	Description string `json:"description"`
+
+	// MinAmount and MaxAmount are the limits in DCR of the tips to the
+	// recipient. They default to, and must be within, the limits of the
+	// faucet.
+	MinAmount string `json:"min_amount"`
+	MaxAmount string `json:"max_amount"`
+
+	// PayoutTokenHash is the hex encoded SHA-256 hash of the token the
+	// recipient authenticates with to withdraw their balance. Recipients
+	// without one can't withdraw.
+	PayoutTokenHash string `json:"payout_token_hash"`
+
+	// minAmount and maxAmount are MinAmount and MaxAmount parsed into
+	// atoms.
+	minAmount dcrutil.Amount
+	maxAmount dcrutil.Amount
+}
+
+// validate checks the recipient configuration, filling in defaults for the
+// optional fields. The limits of the recipient must be within minAmount and
+// maxAmount.
+func (rcpt *recipient) validate(minAmount, maxAmount dcrutil.Amount) error {
+	if !recipientSlugPattern.MatchString(rcpt.Slug) {
+		return fmt.Errorf("invalid recipient slug %q", rcpt.Slug)
+	}
+
+	if rcpt.Name == "" {
+		return fmt.Errorf("recipient %s: missing name", rcpt.Slug)
+	}
+
+	if rcpt.Avatar != "" && !validAvatarURL(rcpt.Avatar) {
+		return fmt.Errorf("recipient %s: invalid avatar %q, expected "+
+			"an http or https URL or an absolute path", rcpt.Slug,
+			rcpt.Avatar)
+	}
+
+	if rcpt.PayoutTokenHash != "" {
+		hash, err := hex.DecodeString(rcpt.PayoutTokenHash)
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("recipient %s: payout_token_hash must "+
+				"be a hex encoded SHA-256 hash", rcpt.Slug)
+		}
+	}
+
+	rcpt.minAmount, rcpt.maxAmount = minAmount, maxAmount
+	if rcpt.MinAmount != "" {
+		atoms, err := parseAmount(rcpt.MinAmount, defaultAmountUnit)
+		if err != nil || atoms < minAmount || atoms > maxAmount {
+			return fmt.Errorf("recipient %s: invalid min_amount %q",
+				rcpt.Slug, rcpt.MinAmount)
+		}
+		rcpt.minAmount = atoms
+	}
+	if rcpt.MaxAmount != "" {
+		atoms, err := parseAmount(rcpt.MaxAmount, defaultAmountUnit)
+		if err != nil || atoms < rcpt.minAmount || atoms > maxAmount {
+			return fmt.Errorf("recipient %s: invalid max_amount %q",
+				rcpt.Slug, rcpt.MaxAmount)
+		}
+		rcpt.maxAmount = atoms
+	}
+
+	return nil
+}
+
+// validAvatarURL reports whether avatar is an absolute http or https URL or
+// an absolute path on the faucet.
+func validAvatarURL(avatar string) bool {
+	u, err := url.Parse(avatar)
+	if err != nil {
+		return false
+	}
+
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return u.Host != ""
+	}
+
+	return u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/")
+}
+
+// checkPayoutToken reports whether token allows withdrawing the balance of
+// the recipient.
+func (rcpt *recipient) checkPayoutToken(token string) bool {
+	if rcpt.PayoutTokenHash == "" {
+		return false
+	}
+
+	want, err := hex.DecodeString(rcpt.PayoutTokenHash)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256([]byte(token))
+
+	return subtle.ConstantTimeCompare(hash[:], want) == 1
+}
+
+// recipientLimits returns the current limits of the amount of the tips to
+// the recipient. Limits the recipient doesn't set follow those of the faucet,
+// and the ones they set are kept within them should they be changed through
+// the admin dashboard.
+func (l *lightningFaucet) recipientLimits(
+	rcpt *recipient) (dcrutil.Amount, dcrutil.Amount) {
+
+	minAmount, maxAmount := l.amountLimits()
+	if rcpt.MinAmount != "" && rcpt.minAmount > minAmount {
+		minAmount = rcpt.minAmount
+	}
+	if rcpt.MaxAmount != "" && rcpt.maxAmount < maxAmount {
+		maxAmount = rcpt.maxAmount
+	}
+
+	return minAmount, maxAmount
+}
+
+// pagePath returns the path of the tip page of the recipient.
+func (rcpt *recipient) pagePath() string {
+	return "/u/" + rcpt.Slug
+}
+
+// loadRecipients reads the recipient registry from the JSON file at path. An
+// empty path means the faucet only receives tips for the node operator. The
+// limits of the recipients must be within minAmount and maxAmount.
+func loadRecipients(path string, minAmount,
+	maxAmount dcrutil.Amount) (map[string]*recipient, error) {
+
+	recipients := make(map[string]*recipient)
+	if path == "" {
+		return recipients, nil
+	}
+
+	recipientsBytes, err := ioutil.ReadFile(cleanAndExpandPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var recipientList []*recipient
+	err = json.Unmarshal(recipientsBytes, &recipientList)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	for _, rcpt := range recipientList {
+		if err := rcpt.validate(minAmount, maxAmount); err != nil {
+			return nil, err
+		}
+		if _, ok := recipients[rcpt.Slug]; ok {
+			return nil, fmt.Errorf("duplicate recipient slug %q",
+				rcpt.Slug)
+		}
+		recipients[rcpt.Slug] = rcpt
+	}
+
+	return recipients, nil
+}
+
+// lookupRecipient returns the recipient identified in the URL, writing a not
+// found error to the response if there's no such recipient.
+func (l *lightningFaucet) lookupRecipient(w http.ResponseWriter,
+	r *http.Request) (*recipient, bool) {
+
+	rcpt, ok := l.recipients[mux.Vars(r)["slug"]]
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	return rcpt, true
+}
+
+// setRecipient customizes the context of a page for the given recipient.
+func (l *lightningFaucet) setRecipient(homeState *homePageContext,
+	rcpt *recipient) {
+
+	minAmount, maxAmount := l.recipientLimits(rcpt)
+	homeState.Recipient = rcpt
+	homeState.PagePath = rcpt.pagePath()
+	homeState.MinAmount = formatAmount(minAmount)
+	homeState.MaxAmount = formatAmount(maxAmount)
+}
+
+// recipientHome renders the tip page of a recipient, handling submissions of
+// its tip form.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) recipientHome(w http.ResponseWriter, r *http.Request) {
+	rcpt, ok := l.lookupRecipient(w, r)
+	if !ok {
+		return
+	}
+
+	homeState := l.newHomePageContext()
+	l.setRecipient(homeState, rcpt)
+	l.renderForm(
+		"index.html", homeState, rcpt.pagePath()+"/invoice/", w, r,
+	)
+}
+
+// recipientButton renders the tip button of a recipient.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) recipientButton(w http.ResponseWriter,
+	r *http.Request) {
+
+	rcpt, ok := l.lookupRecipient(w, r)
+	if !ok {
+		return
+	}
+
+	homeState := l.newHomePageContext()
+	l.setRecipient(homeState, rcpt)
+	l.renderForm(
+		"button.html", homeState, rcpt.pagePath()+"/invoice/", w, r,
+	)
+}
+
+// recipientInvoicePage renders the invoice identified in the URL on the tip
+// page of a recipient. Only invoices of tips to the recipient are displayed.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) recipientInvoicePage(w http.ResponseWriter,
+	r *http.Request) {
+
+	rcpt, ok := l.lookupRecipient(w, r)
+	if !ok {
+		return
+	}
+
+	homeState, ok := l.invoicePageContext(w, r)
+	if !ok {
+		return
+	}
+	if homeState.recipientSlug != rcpt.Slug {
+		http.NotFound(w, r)
+		return
+	}
+	l.setRecipient(homeState, rcpt)
+
+	homeTemplate := l.templates.Lookup("index.html")
+	if err := homeTemplate.Execute(w, homeState); err != nil {
+		log.Errorf("unable to render invoice page: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// invoice.js displays the status of the invoice shown on the page as soon as
+// it changes, and counts down the time left until it expires. Updates are
+// streamed with Server-Sent Events, or over a WebSocket connection by browsers
+// which don't support them.
+(function() {
+  var container = document.querySelector(".invoice-status");
+  if (!container || container.getAttribute("data-status") !== "open") {
+    return;
+  }
+
+  var path = "/invoice/" + container.getAttribute("data-rhash") + "/events";
+  var states = ["open", "settled", "expired", "canceled"];
+
+  // show displays the parts of the page matching the status and returns
+  // whether the invoice is still open.
+  function show(status) {
+    container.setAttribute("data-status", status);
+    for (var i = 0; i < states.length; i++) {
+      var parts = container.querySelectorAll(".invoice-status__" + states[i]);
+      for (var j = 0; j < parts.length; j++) {
+        parts[j].classList.toggle("d-none", states[i] !== status);
+      }
+    }
+
+    return status === "open";
+  }
+
+  // The countdown is formatted the same way as by the server, as [h:]mm:ss.
+  var expiresAt = parseInt(container.getAttribute("data-expires-at"), 10);
+  var countdowns = container.querySelectorAll(".invoice-countdown");
+  function pad(n) {
+    return (n < 10 ? "0" : "") + n;
+  }
+  function tick() {
+    if (container.getAttribute("data-status") !== "open") {
+      clearInterval(timer);
+      return;
+    }
+
+    var left = Math.max(0, expiresAt - Math.floor(Date.now() / 1000));
+    var text = Math.floor(left / 60) + ":" + pad(left % 60);
+    if (left >= 3600) {
+      text = Math.floor(left / 3600) + ":" + pad(Math.floor(left / 60) % 60) +
+        ":" + pad(left % 60);
+    }
+    for (var i = 0; i < countdowns.length; i++) {
+      countdowns[i].textContent = text;
+    }
+
+    // The server reports the expiry as well, but there's no need to wait
+    // for it to offer a fresh invoice.
+    if (left === 0) {
+      show("expired");
+    }
+  }
+  var timer = expiresAt ? setInterval(tick, 1000) : null;
+
+  if (window.EventSource) {
+    // The browser reconnects on its own whenever the stream ends.
+    var source = new EventSource(path);
+    source.addEventListener("status", function(e) {
+      if (!show(JSON.parse(e.data).status)) {
+        source.close();
+      }
+    });
+    return;
+  }
+
+  if (!window.WebSocket) {
+    return;
+  }
+
+  var scheme = window.location.protocol === "https:" ? "wss:" : "ws:";
+  var retries = 0;
+  (function connect() {
+    var open = true;
+    var ws = new WebSocket(scheme + "//" + window.location.host + path);
+    ws.onmessage = function(e) {
+      retries = 0;
+      open = show(JSON.parse(e.data).status);
+    };
+    ws.onclose = function() {
+      if (open && retries < 5) {
+        retries++;
+        setTimeout(connect, 3000 * retries);
+      }
+    };
+  })();
+})();
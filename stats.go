@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/decred/dcrd/dcrutil"
+)
+
+const (
+	// statsDays and statsWeeks are the number of days and weeks covered by
+	// the charts of the stats page.
+	statsDays  = 30
+	statsWeeks = 12
+
+	// statsNumLargest is the number of largest tips listed on the stats
+	// page.
+	statsNumLargest = 10
+
+	// statsCacheDuration is how long the statistics are served before the
+	// tip database is scanned again.
+	statsCacheDuration = time.Minute
+
+	// statsDateLayout is the layout of the dates of the statistics.
+	statsDateLayout = "2006-01-02"
+
+	// maxNicknameLength is the longest nickname, in characters, a tipper
+	// may appear with on the leaderboard.
+	maxNicknameLength = 32
+)
+
+// memoVisibility selects which memos of the settled tips are displayed
+// publicly by the stats page.
+type memoVisibility string
+
+const (
+	// memosHidden hides all memos.
+	memosHidden memoVisibility = "none"
+
+	// memosLeaderboard only displays the memos of tips whose tippers
+	// opted into the leaderboard by giving a nickname.
+	memosLeaderboard memoVisibility = "leaderboard"
+
+	// memosAll displays all memos.
+	memosAll memoVisibility = "all"
+)
+
+// parseMemoVisibility parses the stats_memos option.
+func parseMemoVisibility(s string) (memoVisibility, error) {
+	switch v := memoVisibility(strings.ToLower(s)); v {
+	case memosHidden, memosLeaderboard, memosAll:
+		return v, nil
+	}
+
+	return "", fmt.Errorf("unknown memo visibility %q, must be one of "+
+		"none, leaderboard or all", s)
+}
+
+// publicMemo returns the memo of the tip if it may be displayed publicly.
+func (v memoVisibility) publicMemo(tip *tipRecord) string {
+	switch {
+	case v == memosAll:
+		return tip.Memo
+	case v == memosLeaderboard && tip.Nickname != "":
+		return tip.Memo
+	default:
+		return ""
+	}
+}
+
+// validNickname reports whether the nickname may be displayed on the
+// leaderboard.
+func validNickname(nickname string) bool {
+	if !utf8.ValidString(nickname) ||
+		utf8.RuneCountInString(nickname) > maxNicknameLength {
+
+		return false
+	}
+
+	for _, r := range nickname {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// statsBucket sums the tips settled during a day or week.
+type statsBucket struct {
+	// Date is the first day of the period.
+	Date string `json:"date"`
+
+	NumTips     int    `json:"num_tips"`
+	AmountAtoms int64  `json:"amount_atoms"`
+	Amount      string `json:"amount"`
+
+	// Percent is the amount relative to the largest bucket of the chart,
+	// used to draw its bars.
+	Percent int `json:"-"`
+
+	start time.Time
+}
+
+// publicTip is a settled tip as displayed on the stats page. Only the fields
+// the tipper agreed to make public are filled in.
+type publicTip struct {
+	Date        string `json:"date"`
+	AmountAtoms int64  `json:"amount_atoms"`
+	Amount      string `json:"amount"`
+	Nickname    string `json:"nickname,omitempty"`
+	Memo        string `json:"memo,omitempty"`
+}
+
+// leaderboardEntry sums the tips of a tipper who opted into the leaderboard.
+type leaderboardEntry struct {
+	Rank        int    `json:"rank"`
+	Nickname    string `json:"nickname"`
+	NumTips     int    `json:"num_tips"`
+	AmountAtoms int64  `json:"amount_atoms"`
+	Amount      string `json:"amount"`
+}
+
+// tipStats are the public statistics of the settled tips.
+type tipStats struct {
+	NumTips    int    `json:"num_tips"`
+	TotalAtoms int64  `json:"total_atoms"`
+	Total      string `json:"total"`
+
+	// Daily and Weekly are the tips settled on each of the last statsDays
+	// days and statsWeeks weeks, oldest first.
+	Daily  []*statsBucket `json:"daily"`
+	Weekly []*statsBucket `json:"weekly"`
+
+	// Largest are the largest tips, largest first.
+	Largest []*publicTip `json:"largest"`
+
+	// Leaderboard are the tippers who gave a nickname ordered by the
+	// amount they tipped, or nil when the leaderboard is disabled.
+	Leaderboard []*leaderboardEntry `json:"leaderboard"`
+
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// newStatsBuckets returns n consecutive buckets of the given length, the last
+// one starting at last.
+func newStatsBuckets(last time.Time, n int, days int) []*statsBucket {
+	buckets := make([]*statsBucket, n)
+	for i := range buckets {
+		start := last.AddDate(0, 0, -days*(n-1-i))
+		buckets[i] = &statsBucket{
+			Date:  start.Format(statsDateLayout),
+			start: start,
+		}
+	}
+
+	return buckets
+}
+
+// addToBuckets adds a tip settled at the given time to the bucket covering
+// it, if any. The buckets must be consecutive and sorted.
+func addToBuckets(buckets []*statsBucket, at time.Time, atoms int64) {
+	for i := len(buckets) - 1; i >= 0; i-- {
+		if !at.Before(buckets[i].start) {
+			if i == len(buckets)-1 || at.Before(buckets[i+1].start) {
+				buckets[i].NumTips++
+				buckets[i].AmountAtoms += atoms
+			}
+			return
+		}
+	}
+}
+
+// scaleBuckets formats the amounts of the buckets of a chart and computes
+// their relative size.
+func scaleBuckets(buckets []*statsBucket) {
+	var largest int64
+	for _, b := range buckets {
+		b.Amount = formatAmount(dcrutil.Amount(b.AmountAtoms))
+		if b.AmountAtoms > largest {
+			largest = b.AmountAtoms
+		}
+	}
+	if largest == 0 {
+		return
+	}
+
+	for _, b := range buckets {
+		b.Percent = int(b.AmountAtoms * 100 / largest)
+	}
+}
+
+// computeStats aggregates the tips settled as of now. Memos are only
+// included as allowed by memos, and at most leaderboardSize tippers are
+// ranked. Hidden tips are only counted in the totals and charts.
+func computeStats(store *tipStore, now time.Time, memos memoVisibility,
+	leaderboardSize int) (*tipStats, error) {
+
+	// Days start at midnight UTC and weeks on Mondays.
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+		time.UTC)
+	thisWeek := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+
+	stats := &tipStats{
+		Daily:     newStatsBuckets(today, statsDays, 1),
+		Weekly:    newStatsBuckets(thisWeek, statsWeeks, 7),
+		Largest:   make([]*publicTip, 0, statsNumLargest+1),
+		UpdatedAt: now.Unix(),
+	}
+	tippers := make(map[string]*leaderboardEntry)
+
+	err := store.forEachTip(func(tip *tipRecord) error {
+		if tip.State != tipStateSettled {
+			return nil
+		}
+
+		settledAt := tip.SettledAt
+		if settledAt.IsZero() {
+			settledAt = tip.CreatedAt
+		}
+		settledAt = settledAt.UTC()
+
+		stats.NumTips++
+		stats.TotalAtoms += tip.AmtPaidAtoms
+		addToBuckets(stats.Daily, settledAt, tip.AmtPaidAtoms)
+		addToBuckets(stats.Weekly, settledAt, tip.AmtPaidAtoms)
+
+		if tip.Hidden {
+			return nil
+		}
+
+		stats.Largest = append(stats.Largest, &publicTip{
+			Date:        settledAt.Format(statsDateLayout),
+			AmountAtoms: tip.AmtPaidAtoms,
+			Nickname:    tip.Nickname,
+			Memo:        memos.publicMemo(tip),
+		})
+		sort.SliceStable(stats.Largest, func(i, j int) bool {
+			return stats.Largest[i].AmountAtoms >
+				stats.Largest[j].AmountAtoms
+		})
+		if len(stats.Largest) > statsNumLargest {
+			stats.Largest = stats.Largest[:statsNumLargest]
+		}
+
+		if tip.Nickname == "" {
+			return nil
+		}
+		entry, ok := tippers[tip.Nickname]
+		if !ok {
+			entry = &leaderboardEntry{Nickname: tip.Nickname}
+			tippers[tip.Nickname] = entry
+		}
+		entry.NumTips++
+		entry.AmountAtoms += tip.AmtPaidAtoms
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Total = formatAmount(dcrutil.Amount(stats.TotalAtoms))
+	scaleBuckets(stats.Daily)
+	scaleBuckets(stats.Weekly)
+	for _, tip := range stats.Largest {
+		tip.Amount = formatAmount(dcrutil.Amount(tip.AmountAtoms))
+	}
+
+	if leaderboardSize > 0 {
+		stats.Leaderboard = make([]*leaderboardEntry, 0, len(tippers))
+		for _, entry := range tippers {
+			entry.Amount = formatAmount(dcrutil.Amount(entry.AmountAtoms))
+			stats.Leaderboard = append(stats.Leaderboard, entry)
+		}
+		sort.Slice(stats.Leaderboard, func(i, j int) bool {
+			a, b := stats.Leaderboard[i], stats.Leaderboard[j]
+			if a.AmountAtoms != b.AmountAtoms {
+				return a.AmountAtoms > b.AmountAtoms
+			}
+			return a.Nickname < b.Nickname
+		})
+		if len(stats.Leaderboard) > leaderboardSize {
+			stats.Leaderboard = stats.Leaderboard[:leaderboardSize]
+		}
+		for i, entry := range stats.Leaderboard {
+			entry.Rank = i + 1
+		}
+	}
+
+	return stats, nil
+}
+
+// statsCache serves the statistics of the tips, recomputing them at most
+// once every statsCacheDuration so the page can't be used to keep the tip
+// database busy.
+type statsCache struct {
+	store           *tipStore
+	memos           memoVisibility
+	leaderboardSize int
+
+	mtx       sync.Mutex
+	stats     *tipStats
+	expiresAt time.Time
+}
+
+// newStatsCache creates a cache of the statistics of the tips in store.
+func newStatsCache(store *tipStore, memos memoVisibility,
+	leaderboardSize int) *statsCache {
+
+	return &statsCache{
+		store:           store,
+		memos:           memos,
+		leaderboardSize: leaderboardSize,
+	}
+}
+
+// get returns the current statistics. The returned value is shared and must
+// not be modified.
+func (c *statsCache) get(now time.Time) (*tipStats, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.stats != nil && now.Before(c.expiresAt) {
+		return c.stats, nil
+	}
+
+	stats, err := computeStats(c.store, now, c.memos, c.leaderboardSize)
+	if err != nil {
+		return nil, err
+	}
+	c.stats = stats
+	c.expiresAt = now.Add(statsCacheDuration)
+
+	return stats, nil
+}
+
+// invalidate discards the cached statistics, so the next request recomputes
+// them.
+func (c *statsCache) invalidate() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.stats = nil
+}
+
+// statsPageContext is the context used to render the stats page.
+type statsPageContext struct {
+	*homePageContext
+
+	Stats *tipStats
+}
+
+// statsPage renders the public statistics of the tips.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) statsPage(w http.ResponseWriter, r *http.Request) {
+	stats, err := l.stats.get(time.Now())
+	if err != nil {
+		log.Errorf("Unable to compute tip statistics: %v", err)
+		http.Error(w, "unable to compute statistics",
+			http.StatusInternalServerError)
+		return
+	}
+
+	statsTemplate := l.templates.Lookup("stats.html")
+	err = statsTemplate.Execute(w, &statsPageContext{
+		homePageContext: l.newHomePageContext(),
+		Stats:           stats,
+	})
+	if err != nil {
+		log.Errorf("unable to render stats page: %v", err)
+	}
+}
+
+// apiStats returns the public statistics of the tips.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) apiStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := l.stats.get(time.Now())
+	if err != nil {
+		log.Errorf("Unable to compute tip statistics: %v", err)
+		writeAPIError(w, http.StatusInternalServerError,
+			"stats_unavailable", "unable to compute statistics")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,1052 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// tipStoreFilename is the name of the database file within the data
+	// directory.
+	tipStoreFilename = "tips.db"
+
+	// tipStoreOpenTimeout is how long to wait for the lock on the
+	// database, held by any other running instance.
+	tipStoreOpenTimeout = time.Second
+)
+
+var (
+	// metaBucket holds the metadata of the database, such as its version.
+	metaBucket = []byte("meta")
+
+	// versionKey is the key within metaBucket of the schema version.
+	versionKey = []byte("version")
+
+	// invoiceCursorKey is the key within metaBucket of the indexes of the
+	// last invoice events recorded by the invoice tracker.
+	invoiceCursorKey = []byte("invoice_cursor")
+
+	// tipsBucket holds the tip records keyed by payment hash.
+	tipsBucket = []byte("tips")
+
+	// balancesBucket holds the balance in atoms of each recipient keyed
+	// by slug.
+	balancesBucket = []byte("balances")
+
+	// withdrawalsBucket holds the withdrawal records keyed by the payment
+	// hash of the paid invoice.
+	withdrawalsBucket = []byte("withdrawals")
+
+	// webhooksBucket holds a bucket of webhook deliveries per endpoint,
+	// keyed by delivery ID.
+	webhooksBucket = []byte("webhooks")
+
+	// closuresBucket holds the records of the channels closed by the
+	// faucet, keyed by closure ID.
+	closuresBucket = []byte("closures")
+
+	// errTipNotFound is returned when there's no tip with the requested
+	// payment hash.
+	errTipNotFound = errors.New("tip not found")
+
+	// errWithdrawalNotFound is returned when there's no withdrawal with
+	// the requested payment hash.
+	errWithdrawalNotFound = errors.New("withdrawal not found")
+
+	// errWithdrawalNotPending is returned when recording the outcome of a
+	// withdrawal whose outcome is already known.
+	errWithdrawalNotPending = errors.New("withdrawal not pending")
+
+	// errInsufficientBalance is returned when a withdrawal exceeds the
+	// balance of the recipient.
+	errInsufficientBalance = errors.New("insufficient balance")
+
+	// errDeliveryNotFound is returned when there's no webhook delivery
+	// with the requested ID.
+	errDeliveryNotFound = errors.New("webhook delivery not found")
+
+	// errDeliveryNotFailed is returned when retrying a webhook delivery
+	// which wasn't given up.
+	errDeliveryNotFailed = errors.New("webhook delivery not failed")
+)
+
+// migration upgrades the database from the previous schema version.
+type migration func(tx *bolt.Tx) error
+
+// migrations are the schema upgrades in order. The schema version of a
+// database is the number of migrations applied to it, so new migrations must
+// only ever be appended.
+var migrations = []migration{
+	// Version 1 creates the initial buckets.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tipsBucket)
+		return err
+	},
+
+	// Version 2 adds the balances of the recipients, crediting them with
+	// the tips already settled, and their withdrawals.
+	func(tx *bolt.Tx) error {
+		balances, err := tx.CreateBucketIfNotExists(balancesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(withdrawalsBucket)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(tipsBucket).ForEach(func(_, tipBytes []byte) error {
+			var tip tipRecord
+			if err := json.Unmarshal(tipBytes, &tip); err != nil {
+				return err
+			}
+			if tip.Recipient == "" || tip.State != tipStateSettled {
+				return nil
+			}
+
+			return addBalance(balances, tip.Recipient, tip.AmtPaidAtoms)
+		})
+	},
+
+	// Version 3 adds the webhook deliveries.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(webhooksBucket)
+		return err
+	},
+
+	// Version 4 adds the closed channels.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(closuresBucket)
+		return err
+	},
+}
+
+// tipState is the settlement state of a recorded tip.
+type tipState string
+
+const (
+	// tipStateOpen indicates the invoice of the tip hasn't been paid
+	// yet.
+	tipStateOpen tipState = "open"
+
+	// tipStateSettled indicates the invoice of the tip has been paid.
+	tipStateSettled tipState = "settled"
+
+	// tipStateCanceled indicates the invoice of the tip was canceled.
+	tipStateCanceled tipState = "canceled"
+)
+
+// tipRecord is a tip request as stored in the database.
+type tipRecord struct {
+	RHash    []byte `json:"rhash"`
+	AddIndex uint64 `json:"add_index"`
+
+	// AmountAtoms is the amount requested by the invoice, zero when the
+	// tipper may pay any amount, and AmtPaidAtoms the amount that was
+	// actually paid.
+	AmountAtoms  int64 `json:"amount_atoms"`
+	AmtPaidAtoms int64 `json:"amt_paid_atoms,omitempty"`
+
+	// MinAtoms and MaxAtoms are the limits the amount paid for an
+	// open-amount tip is checked against on settlement.
+	MinAtoms int64 `json:"min_atoms,omitempty"`
+	MaxAtoms int64 `json:"max_atoms,omitempty"`
+
+	Memo           string `json:"memo,omitempty"`
+	PaymentRequest string `json:"payment_request"`
+
+	// Nickname is the name the tipper chose to appear with on the
+	// leaderboard, empty if they didn't opt into it.
+	Nickname string `json:"nickname,omitempty"`
+
+	// RemoteAddr and UserAgent describe the client which requested the
+	// tip.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+
+	// Widget is the ID of the widget the tip was requested through, if
+	// any.
+	Widget string `json:"widget,omitempty"`
+
+	// Recipient is the slug of the recipient the tip is for, empty for
+	// tips to the node operator.
+	Recipient string `json:"recipient,omitempty"`
+
+	// Hidden indicates the operator hid the tip, for instance because of
+	// an abusive memo. Hidden tips still count towards the totals but are
+	// otherwise not displayed publicly.
+	Hidden bool `json:"hidden,omitempty"`
+
+	State     tipState      `json:"state"`
+	CreatedAt time.Time     `json:"created_at"`
+	Expiry    time.Duration `json:"expiry"`
+	SettledAt time.Time     `json:"settled_at,omitempty"`
+}
+
+// openAmount returns whether the tipper may pay any amount.
+func (tip *tipRecord) openAmount() bool {
+	return tip.AmountAtoms == 0
+}
+
+// policyViolation returns how the amount paid for an open-amount tip falls
+// outside of its limits, empty if it doesn't.
+func (tip *tipRecord) policyViolation() string {
+	switch {
+	case !tip.openAmount():
+		return ""
+	case tip.AmtPaidAtoms < tip.MinAtoms:
+		return "below_min"
+	case tip.MaxAtoms > 0 && tip.AmtPaidAtoms > tip.MaxAtoms:
+		return "above_max"
+	default:
+		return ""
+	}
+}
+
+// status returns the status of the invoice of the tip at the given time.
+func (tip *tipRecord) status(now time.Time) invoiceStatus {
+	switch {
+	case tip.State == tipStateSettled:
+		return invoiceStatusSettled
+	case tip.State == tipStateCanceled:
+		return invoiceStatusCanceled
+	case now.After(tip.CreatedAt.Add(tip.Expiry)):
+		return invoiceStatusExpired
+	default:
+		return invoiceStatusOpen
+	}
+}
+
+// tipStore is the persistent ledger of the tips requested through the
+// faucet, kept in an embedded bbolt database.
+type tipStore struct {
+	db *bolt.DB
+
+	// webhookEndpoints are the IDs of the webhook endpoints notified of
+	// the settled tips. It must be set before the store is used
+	// concurrently.
+	webhookEndpoints []string
+}
+
+// openTipStore opens the database at path, creating it if needed, and
+// upgrades it to the latest schema version.
+func openTipStore(path string) (*tipStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout: tipStoreOpenTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %v", path, err)
+	}
+
+	s := &tipStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// migrate applies the migrations the database is missing. All of them are
+// applied in a single transaction, so a failed upgrade leaves the database
+// untouched.
+func (s *tipStore) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		var version uint32
+		if versionBytes := meta.Get(versionKey); versionBytes != nil {
+			version = binary.BigEndian.Uint32(versionBytes)
+		}
+
+		latest := uint32(len(migrations))
+		if version > latest {
+			return fmt.Errorf("database version %d is newer than "+
+				"the latest known version %d", version, latest)
+		}
+		if version == latest {
+			return nil
+		}
+
+		for v := version; v < latest; v++ {
+			log.Infof("Upgrading tip database to version %d", v+1)
+			if err := migrations[v](tx); err != nil {
+				return fmt.Errorf("unable to upgrade tip database "+
+					"to version %d: %v", v+1, err)
+			}
+		}
+
+		var versionBytes [4]byte
+		binary.BigEndian.PutUint32(versionBytes[:], latest)
+		return meta.Put(versionKey, versionBytes[:])
+	})
+}
+
+// Close closes the database.
+func (s *tipStore) Close() error {
+	return s.db.Close()
+}
+
+// putTip stores a tip, replacing any previous record with the same payment
+// hash.
+func (s *tipStore) putTip(tip *tipRecord) error {
+	tipBytes, err := json.Marshal(tip)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tipsBucket).Put(tip.RHash, tipBytes)
+	})
+}
+
+// fetchTip returns the tip with the given payment hash.
+func (s *tipStore) fetchTip(rHash []byte) (*tipRecord, error) {
+	var tip tipRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tipBytes := tx.Bucket(tipsBucket).Get(rHash)
+		if tipBytes == nil {
+			return errTipNotFound
+		}
+
+		return json.Unmarshal(tipBytes, &tip)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tip, nil
+}
+
+// updateTip applies update to the tip with the given payment hash within a
+// single transaction. When the tip becomes settled, the balance of its
+// recipient is credited and the webhook deliveries are queued within the same
+// transaction.
+func (s *tipStore) updateTip(rHash []byte, update func(*tipRecord)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.updateTipTx(tx, rHash, update)
+	})
+}
+
+// updateTipTx applies update to the tip with the given payment hash within
+// the given transaction, as described by updateTip.
+func (s *tipStore) updateTipTx(tx *bolt.Tx, rHash []byte,
+	update func(*tipRecord)) error {
+
+	tips := tx.Bucket(tipsBucket)
+
+	tipBytes := tips.Get(rHash)
+	if tipBytes == nil {
+		return errTipNotFound
+	}
+
+	var tip tipRecord
+	if err := json.Unmarshal(tipBytes, &tip); err != nil {
+		return err
+	}
+	wasSettled := tip.State == tipStateSettled
+	update(&tip)
+	settled := !wasSettled && tip.State == tipStateSettled
+
+	if tip.Recipient != "" && settled {
+		err := addBalance(
+			tx.Bucket(balancesBucket), tip.Recipient,
+			tip.AmtPaidAtoms,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if settled {
+		if err := s.queueWebhooks(tx, &tip); err != nil {
+			return err
+		}
+	}
+
+	tipBytes, err := json.Marshal(&tip)
+	if err != nil {
+		return err
+	}
+
+	return tips.Put(rHash, tipBytes)
+}
+
+// fetchInvoiceCursor returns the invoice subscription cursor, and whether one
+// was stored at all.
+func (s *tipStore) fetchInvoiceCursor() (invoiceCursor, bool, error) {
+	var cursor invoiceCursor
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursorBytes := tx.Bucket(metaBucket).Get(invoiceCursorKey)
+		if cursorBytes == nil {
+			return nil
+		}
+
+		found = true
+		return json.Unmarshal(cursorBytes, &cursor)
+	})
+
+	return cursor, found, err
+}
+
+// putInvoiceCursor stores the invoice subscription cursor.
+func (s *tipStore) putInvoiceCursor(cursor invoiceCursor) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putInvoiceCursor(tx, cursor)
+	})
+}
+
+// putInvoiceCursor stores the invoice subscription cursor within the given
+// transaction.
+func putInvoiceCursor(tx *bolt.Tx, cursor invoiceCursor) error {
+	cursorBytes, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(metaBucket).Put(invoiceCursorKey, cursorBytes)
+}
+
+// recordInvoiceEvent applies update, if not nil, to the tip with the given
+// payment hash and advances the invoice subscription cursor within a single
+// transaction, so an event can't be skipped without its outcome recorded.
+// Invoices which aren't tips only advance the cursor. It returns whether the
+// invoice is a tip.
+func (s *tipStore) recordInvoiceEvent(rHash []byte, update func(*tipRecord),
+	cursor invoiceCursor) (bool, error) {
+
+	var isTip bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		isTip = tx.Bucket(tipsBucket).Get(rHash) != nil
+		if isTip && update != nil {
+			if err := s.updateTipTx(tx, rHash, update); err != nil {
+				return err
+			}
+		}
+
+		return putInvoiceCursor(tx, cursor)
+	})
+
+	return isTip, err
+}
+
+// forEachTip calls f for every stored tip, stopping at the first error.
+func (s *tipStore) forEachTip(f func(*tipRecord) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tipsBucket).ForEach(func(_, tipBytes []byte) error {
+			var tip tipRecord
+			if err := json.Unmarshal(tipBytes, &tip); err != nil {
+				return err
+			}
+
+			return f(&tip)
+		})
+	})
+}
+
+// getBalance returns the balance in atoms of the recipient stored in the
+// balances bucket.
+func getBalance(balances *bolt.Bucket, slug string) int64 {
+	balanceBytes := balances.Get([]byte(slug))
+	if balanceBytes == nil {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(balanceBytes))
+}
+
+// addBalance adds delta atoms, which may be negative, to the balance of the
+// recipient stored in the balances bucket. The balance can't become negative.
+func addBalance(balances *bolt.Bucket, slug string, delta int64) error {
+	balance := getBalance(balances, slug) + delta
+	if balance < 0 {
+		return errInsufficientBalance
+	}
+
+	var balanceBytes [8]byte
+	binary.BigEndian.PutUint64(balanceBytes[:], uint64(balance))
+	return balances.Put([]byte(slug), balanceBytes[:])
+}
+
+// fetchBalance returns the balance in atoms of the recipient.
+func (s *tipStore) fetchBalance(slug string) (int64, error) {
+	var balance int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		balance = getBalance(tx.Bucket(balancesBucket), slug)
+		return nil
+	})
+
+	return balance, err
+}
+
+// withdrawalState is the state of a withdrawal.
+type withdrawalState string
+
+const (
+	// withdrawalStatePending indicates the payment of the withdrawal was
+	// started and its outcome isn't known yet.
+	withdrawalStatePending withdrawalState = "pending"
+
+	// withdrawalStateSucceeded indicates the withdrawal was paid.
+	withdrawalStateSucceeded withdrawalState = "succeeded"
+
+	// withdrawalStateFailed indicates the payment of the withdrawal
+	// failed and the reserved amount was returned to the balance.
+	withdrawalStateFailed withdrawalState = "failed"
+)
+
+// withdrawalRecord is a withdrawal of the balance of a recipient, paid to an
+// invoice of theirs, as stored in the database.
+type withdrawalRecord struct {
+	// PaymentHash is the hash of the paid invoice, which identifies the
+	// withdrawal.
+	PaymentHash    []byte `json:"payment_hash"`
+	Recipient      string `json:"recipient"`
+	PaymentRequest string `json:"payment_request"`
+
+	// AmountAtoms is the amount of the invoice. FeeLimitAtoms is the
+	// largest routing fee the recipient may be charged and FeeAtoms the
+	// fee actually paid. The amount plus the fee limit is reserved from
+	// the balance while the payment is pending.
+	AmountAtoms   int64 `json:"amount_atoms"`
+	FeeLimitAtoms int64 `json:"fee_limit_atoms"`
+	FeeAtoms      int64 `json:"fee_atoms,omitempty"`
+
+	State withdrawalState `json:"state"`
+
+	// Error describes why the payment failed or why its outcome is
+	// unknown.
+	Error string `json:"error,omitempty"`
+
+	PaymentPreimage []byte    `json:"payment_preimage,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	CompletedAt     time.Time `json:"completed_at,omitempty"`
+}
+
+// reserved returns the amount reserved from the balance of the recipient
+// while the withdrawal is pending.
+func (w *withdrawalRecord) reserved() int64 {
+	return w.AmountAtoms + w.FeeLimitAtoms
+}
+
+// putWithdrawal stores the withdrawal record in the withdrawals bucket.
+func putWithdrawal(withdrawals *bolt.Bucket, w *withdrawalRecord) error {
+	withdrawalBytes, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+
+	return withdrawals.Put(w.PaymentHash, withdrawalBytes)
+}
+
+// getWithdrawal returns the withdrawal record with the given payment hash
+// stored in the withdrawals bucket.
+func getWithdrawal(withdrawals *bolt.Bucket,
+	paymentHash []byte) (*withdrawalRecord, error) {
+
+	withdrawalBytes := withdrawals.Get(paymentHash)
+	if withdrawalBytes == nil {
+		return nil, errWithdrawalNotFound
+	}
+
+	var w withdrawalRecord
+	if err := json.Unmarshal(withdrawalBytes, &w); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// fetchWithdrawal returns the withdrawal with the given payment hash.
+func (s *tipStore) fetchWithdrawal(
+	paymentHash []byte) (*withdrawalRecord, error) {
+
+	var w *withdrawalRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		w, err = getWithdrawal(tx.Bucket(withdrawalsBucket), paymentHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// beginWithdrawal stores a new pending withdrawal, reserving its amount and
+// fee limit from the balance of the recipient. If the invoice was already
+// paid, or is being paid, no new withdrawal is stored and the existing one is
+// returned instead, so an invoice is never paid twice. Failed withdrawals may
+// be retried.
+func (s *tipStore) beginWithdrawal(
+	w *withdrawalRecord) (existing *withdrawalRecord, err error) {
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		withdrawals := tx.Bucket(withdrawalsBucket)
+
+		prev, err := getWithdrawal(withdrawals, w.PaymentHash)
+		switch {
+		case err == errWithdrawalNotFound:
+		case err != nil:
+			return err
+		case prev.State != withdrawalStateFailed:
+			existing = prev
+			return nil
+		}
+
+		err = addBalance(
+			tx.Bucket(balancesBucket), w.Recipient, -w.reserved(),
+		)
+		if err != nil {
+			return err
+		}
+
+		return putWithdrawal(withdrawals, w)
+	})
+
+	return existing, err
+}
+
+// finishWithdrawal records the outcome of a pending withdrawal, returning to
+// the balance of the recipient whatever part of the reserved amount wasn't
+// spent.
+func (s *tipStore) finishWithdrawal(paymentHash []byte,
+	update func(*withdrawalRecord)) (*withdrawalRecord, error) {
+
+	var w *withdrawalRecord
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		withdrawals := tx.Bucket(withdrawalsBucket)
+
+		var err error
+		w, err = getWithdrawal(withdrawals, paymentHash)
+		if err != nil {
+			return err
+		}
+		if w.State != withdrawalStatePending {
+			return errWithdrawalNotPending
+		}
+		update(w)
+
+		var refund int64
+		switch w.State {
+		case withdrawalStateSucceeded:
+			refund = w.reserved() - w.AmountAtoms - w.FeeAtoms
+
+			// The fee reported by dcrlnd isn't checked against the
+			// limit, so the faucet bears any overspend rather than
+			// leaving the withdrawal pending.
+			if refund < 0 {
+				log.Warnf("Withdrawal %x of %s paid a fee of %d "+
+					"atoms exceeding its limit of %d atoms",
+					w.PaymentHash, w.Recipient, w.FeeAtoms,
+					w.FeeLimitAtoms)
+				refund = 0
+			}
+		case withdrawalStateFailed:
+			refund = w.reserved()
+		}
+		err = addBalance(tx.Bucket(balancesBucket), w.Recipient, refund)
+		if err != nil {
+			return err
+		}
+
+		return putWithdrawal(withdrawals, w)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// pendingWithdrawals returns the withdrawals whose outcome isn't known yet,
+// oldest first.
+func (s *tipStore) pendingWithdrawals() ([]*withdrawalRecord, error) {
+	var pending []*withdrawalRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		withdrawals := tx.Bucket(withdrawalsBucket)
+		return withdrawals.ForEach(func(_, withdrawalBytes []byte) error {
+			var w withdrawalRecord
+			err := json.Unmarshal(withdrawalBytes, &w)
+			if err != nil {
+				return err
+			}
+
+			if w.State == withdrawalStatePending {
+				pending = append(pending, &w)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+
+	return pending, nil
+}
+
+// updateWithdrawal applies update to the withdrawal with the given payment
+// hash without affecting the balance of the recipient.
+func (s *tipStore) updateWithdrawal(paymentHash []byte,
+	update func(*withdrawalRecord)) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		withdrawals := tx.Bucket(withdrawalsBucket)
+
+		w, err := getWithdrawal(withdrawals, paymentHash)
+		if err != nil {
+			return err
+		}
+		update(w)
+
+		return putWithdrawal(withdrawals, w)
+	})
+}
+
+// webhookDeliveryState is the state of a webhook delivery.
+type webhookDeliveryState string
+
+const (
+	// webhookDeliveryPending indicates the delivery hasn't succeeded yet
+	// and will be attempted again.
+	webhookDeliveryPending webhookDeliveryState = "pending"
+
+	// webhookDeliveryDelivered indicates the endpoint accepted the
+	// delivery.
+	webhookDeliveryDelivered webhookDeliveryState = "delivered"
+
+	// webhookDeliveryFailed indicates the delivery was given up after
+	// too many failed attempts.
+	webhookDeliveryFailed webhookDeliveryState = "failed"
+)
+
+// webhookDelivery is the notification of a webhook endpoint, as stored in
+// the database.
+type webhookDelivery struct {
+	// ID identifies the delivery among those of all endpoints.
+	ID       uint64 `json:"id"`
+	Endpoint string `json:"endpoint"`
+
+	// RHash is the payment hash of the tip the delivery is about.
+	RHash []byte `json:"rhash"`
+
+	// Payload is the body sent to the endpoint. It's built when the
+	// delivery is queued so every attempt sends the same body.
+	Payload json.RawMessage `json:"payload"`
+
+	State    webhookDeliveryState `json:"state"`
+	Attempts int                  `json:"attempts"`
+
+	// LastStatus is the HTTP status code of the last response, and
+	// LastError why the last attempt failed.
+	LastStatus int    `json:"last_status,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+
+	CreatedAt   time.Time `json:"created_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+}
+
+// idKey returns the key of the record with the given ID, such as a webhook
+// delivery or a channel closure. IDs are big endian so records are sorted by
+// ID.
+func idKey(id uint64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], id)
+	return key[:]
+}
+
+// putDelivery stores the delivery in the bucket of its endpoint within the
+// webhooks bucket.
+func putDelivery(webhooks *bolt.Bucket, d *webhookDelivery) error {
+	deliveries, err := webhooks.CreateBucketIfNotExists([]byte(d.Endpoint))
+	if err != nil {
+		return err
+	}
+
+	deliveryBytes, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return deliveries.Put(idKey(d.ID), deliveryBytes)
+}
+
+// queueWebhooks queues the delivery of the notification of the settlement of
+// the tip to every webhook endpoint.
+func (s *tipStore) queueWebhooks(tx *bolt.Tx, tip *tipRecord) error {
+	webhooks := tx.Bucket(webhooksBucket)
+	now := time.Now()
+
+	for _, endpoint := range s.webhookEndpoints {
+		id, err := webhooks.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		payload, err := json.Marshal(newWebhookPayload(id, tip))
+		if err != nil {
+			return err
+		}
+
+		err = putDelivery(webhooks, &webhookDelivery{
+			ID:          id,
+			Endpoint:    endpoint,
+			RHash:       tip.RHash,
+			Payload:     payload,
+			State:       webhookDeliveryPending,
+			CreatedAt:   now,
+			NextAttempt: now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forEachDelivery calls f for every delivery of the endpoint stored in the
+// webhooks bucket, stopping at the first error.
+func forEachDelivery(webhooks *bolt.Bucket, endpoint string,
+	f func(*webhookDelivery) error) error {
+
+	deliveries := webhooks.Bucket([]byte(endpoint))
+	if deliveries == nil {
+		return nil
+	}
+
+	return deliveries.ForEach(func(_, deliveryBytes []byte) error {
+		var d webhookDelivery
+		if err := json.Unmarshal(deliveryBytes, &d); err != nil {
+			return err
+		}
+
+		return f(&d)
+	})
+}
+
+// nextDelivery returns the pending delivery of the endpoint due first, or
+// nil if there's none.
+func (s *tipStore) nextDelivery(endpoint string) (*webhookDelivery, error) {
+	var next *webhookDelivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		webhooks := tx.Bucket(webhooksBucket)
+		return forEachDelivery(webhooks, endpoint, func(d *webhookDelivery) error {
+			if d.State != webhookDeliveryPending {
+				return nil
+			}
+			if next == nil || d.NextAttempt.Before(next.NextAttempt) {
+				next = d
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+// updateDelivery stores the outcome of an attempt to deliver a webhook.
+func (s *tipStore) updateDelivery(d *webhookDelivery) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putDelivery(tx.Bucket(webhooksBucket), d)
+	})
+}
+
+// retryDelivery queues a failed delivery again, due at the given time.
+func (s *tipStore) retryDelivery(endpoint string, id uint64,
+	now time.Time) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		webhooks := tx.Bucket(webhooksBucket)
+		deliveries := webhooks.Bucket([]byte(endpoint))
+		if deliveries == nil {
+			return errDeliveryNotFound
+		}
+
+		deliveryBytes := deliveries.Get(idKey(id))
+		if deliveryBytes == nil {
+			return errDeliveryNotFound
+		}
+
+		var d webhookDelivery
+		if err := json.Unmarshal(deliveryBytes, &d); err != nil {
+			return err
+		}
+		if d.State != webhookDeliveryFailed {
+			return errDeliveryNotFailed
+		}
+
+		d.State = webhookDeliveryPending
+		d.Attempts = 0
+		d.NextAttempt = now
+		d.CompletedAt = time.Time{}
+
+		return putDelivery(webhooks, &d)
+	})
+}
+
+// pruneDeliveries removes the deliveries of the endpoint completed before
+// the given time.
+func (s *tipStore) pruneDeliveries(endpoint string, before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		webhooks := tx.Bucket(webhooksBucket)
+
+		var prune [][]byte
+		err := forEachDelivery(webhooks, endpoint, func(d *webhookDelivery) error {
+			if d.State != webhookDeliveryPending &&
+				d.CompletedAt.Before(before) {
+
+				prune = append(prune, idKey(d.ID))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		deliveries := webhooks.Bucket([]byte(endpoint))
+		for _, key := range prune {
+			if err := deliveries.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// recentDeliveries returns the n most recently queued deliveries of all
+// endpoints, newest first.
+func (s *tipStore) recentDeliveries(n int) ([]*webhookDelivery, error) {
+	var recent []*webhookDelivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(endpoint, v []byte) error {
+			// Only the buckets of the endpoints are stored in the
+			// webhooks bucket.
+			if v != nil {
+				return nil
+			}
+
+			// Delivery IDs increase, so the most recent ones of
+			// the endpoint are at the end of its bucket.
+			c := tx.Bucket(webhooksBucket).Bucket(endpoint).Cursor()
+			k, deliveryBytes := c.Last()
+			for i := 0; k != nil && i < n; i++ {
+				var d webhookDelivery
+				err := json.Unmarshal(deliveryBytes, &d)
+				if err != nil {
+					return err
+				}
+				recent = append(recent, &d)
+
+				k, deliveryBytes = c.Prev()
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].ID > recent[j].ID
+	})
+	if len(recent) > n {
+		recent = recent[:n]
+	}
+
+	return recent, nil
+}
+
+// channelClosure is a channel closed by the faucet, as stored in the
+// database.
+type channelClosure struct {
+	// ID identifies the closure, and increases with every closure.
+	ID uint64 `json:"id"`
+
+	ChannelPoint string `json:"channel_point"`
+	RemotePubkey string `json:"remote_pubkey"`
+	Capacity     int64  `json:"capacity"`
+
+	// FundingHeight is the height of the block which confirmed the
+	// funding transaction, and AgeBlocks the number of blocks mined
+	// since then when the channel was closed.
+	FundingHeight uint32 `json:"funding_height"`
+	AgeBlocks     uint32 `json:"age_blocks"`
+
+	// Reason is why the channel was closed, and Force whether it had to
+	// be force closed.
+	Reason closeReason `json:"reason"`
+	Force  bool        `json:"force,omitempty"`
+
+	// ClosingTxid is the hash of the transaction closing the channel.
+	ClosingTxid string `json:"closing_txid"`
+
+	ClosedAt time.Time `json:"closed_at"`
+}
+
+// putClosure records a closed channel, assigning the closure its ID.
+func (s *tipStore) putClosure(c *channelClosure) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		closures := tx.Bucket(closuresBucket)
+
+		id, err := closures.NextSequence()
+		if err != nil {
+			return err
+		}
+		c.ID = id
+
+		closureBytes, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+
+		return closures.Put(idKey(id), closureBytes)
+	})
+}
+
+// recentClosures returns the n most recently closed channels, newest first.
+func (s *tipStore) recentClosures(n int) ([]*channelClosure, error) {
+	var recent []*channelClosure
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(closuresBucket).Cursor()
+		k, closureBytes := c.Last()
+		for i := 0; k != nil && i < n; i++ {
+			var closure channelClosure
+			err := json.Unmarshal(closureBytes, &closure)
+			if err != nil {
+				return err
+			}
+			recent = append(recent, &closure)
+
+			k, closureBytes = c.Prev()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return recent, nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil"
+)
+
+const (
+	// webhookEventSettled is the event notified when a tip is settled.
+	webhookEventSettled = "tip.settled"
+
+	// webhookTimeout is the deadline of each attempt to deliver a
+	// webhook.
+	webhookTimeout = 10 * time.Second
+
+	// webhookMinBackoff is the time to wait before retrying a failed
+	// delivery. The wait doubles with every failed attempt up to
+	// webhookMaxBackoff.
+	webhookMinBackoff = 10 * time.Second
+
+	// webhookMaxBackoff is the longest time to wait before retrying a
+	// failed delivery.
+	webhookMaxBackoff = time.Hour
+
+	// webhookMaxAttempts is the number of failed attempts after which a
+	// delivery is given up, spanning about a day.
+	webhookMaxAttempts = 30
+
+	// webhookRetention is how long completed deliveries are kept for the
+	// delivery log of the admin dashboard.
+	webhookRetention = 7 * 24 * time.Hour
+
+	// webhookMaxResponseSize is the largest part of a response read
+	// before the connection is closed.
+	webhookMaxResponseSize = 64 * 1024
+
+	// minWebhookSecretSize is the shortest secret accepted to sign the
+	// deliveries.
+	minWebhookSecretSize = 16
+
+	// webhookSignatureHeader, webhookEventHeader and webhookDeliveryHeader
+	// are the headers of the deliveries carrying their signature, event
+	// and ID.
+	webhookSignatureHeader = "X-Dcrtippin-Signature"
+	webhookEventHeader     = "X-Dcrtippin-Event"
+	webhookDeliveryHeader  = "X-Dcrtippin-Delivery"
+)
+
+var (
+	// webhookIDPattern matches the valid webhook identifiers.
+	webhookIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+)
+
+// webhookPayload is the body of the notification of a settled tip.
+type webhookPayload struct {
+	// ID identifies the delivery, so endpoints can recognize the ones
+	// they already processed.
+	ID    uint64 `json:"id"`
+	Event string `json:"event"`
+
+	PaymentHash string `json:"payment_hash"`
+	AmountAtoms int64  `json:"amount_atoms"`
+	Amount      string `json:"amount"`
+	Memo        string `json:"memo,omitempty"`
+	Recipient   string `json:"recipient,omitempty"`
+	SettledAt   int64  `json:"settled_at"`
+}
+
+// newWebhookPayload returns the payload of the delivery with the given ID
+// notifying the settlement of the tip.
+func newWebhookPayload(id uint64, tip *tipRecord) *webhookPayload {
+	settledAt := tip.SettledAt
+	if settledAt.IsZero() {
+		settledAt = time.Now()
+	}
+
+	return &webhookPayload{
+		ID:          id,
+		Event:       webhookEventSettled,
+		PaymentHash: hex.EncodeToString(tip.RHash),
+		AmountAtoms: tip.AmtPaidAtoms,
+		Amount:      formatAmount(dcrutil.Amount(tip.AmtPaidAtoms)),
+		Memo:        tip.Memo,
+		Recipient:   tip.Recipient,
+		SettledAt:   settledAt.Unix(),
+	}
+}
+
+// signWebhook returns the signature of a delivery sent at the given time. The
+// time is signed along with the body so a captured delivery can't be replayed
+// later on.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%d,v1=%x", timestamp, mac.Sum(nil))
+}
+
+// webhookBackoff returns the time to wait before the next attempt of a
+// delivery which failed the given number of times.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookMinBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+
+	return backoff
+}
+
+// webhookEndpoint is a URL notified of the settled tips.
+type webhookEndpoint struct {
+	// ID identifies the endpoint in the delivery log. Changing it loses
+	// track of the deliveries still pending.
+	ID string `json:"id"`
+
+	// URL is where the notifications are posted.
+	URL string `json:"url"`
+
+	// Secret is the key of the HMAC-SHA256 signature of the deliveries.
+	Secret string `json:"secret"`
+
+	// wake is signaled when deliveries are queued for the endpoint.
+	wake chan struct{}
+}
+
+// validate checks the configuration of the endpoint.
+func (e *webhookEndpoint) validate() error {
+	if !webhookIDPattern.MatchString(e.ID) {
+		return fmt.Errorf("invalid webhook id %q", e.ID)
+	}
+
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+
+		return fmt.Errorf("webhook %s: invalid url %q, expected an "+
+			"http or https URL", e.ID, e.URL)
+	}
+
+	if len(e.Secret) < minWebhookSecretSize {
+		return fmt.Errorf("webhook %s: secret must be at least %d "+
+			"characters long", e.ID, minWebhookSecretSize)
+	}
+
+	return nil
+}
+
+// loadWebhooks reads the webhook endpoints from the JSON file at path. An
+// empty path means no webhook is configured.
+func loadWebhooks(path string) ([]*webhookEndpoint, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	webhooksBytes, err := ioutil.ReadFile(cleanAndExpandPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*webhookEndpoint
+	err = json.Unmarshal(webhooksBytes, &endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	ids := make(map[string]struct{})
+	for _, e := range endpoints {
+		if err := e.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := ids[e.ID]; ok {
+			return nil, fmt.Errorf("duplicate webhook id %q", e.ID)
+		}
+		ids[e.ID] = struct{}{}
+		e.wake = make(chan struct{}, 1)
+	}
+
+	return endpoints, nil
+}
+
+// webhookDispatcher delivers the notifications queued in the tip database to
+// the webhook endpoints. Each endpoint is served by its own goroutine so a
+// slow endpoint doesn't delay the others. Failed deliveries are retried with
+// an exponential backoff, and as they're stored in the database, retries
+// resume after a restart.
+type webhookDispatcher struct {
+	store     *tipStore
+	endpoints []*webhookEndpoint
+	client    *http.Client
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newWebhookDispatcher creates a dispatcher delivering the notifications of
+// the tips settled in store to the given endpoints. It must be created before
+// any tip is settled, as only the endpoints it registers with the store get
+// notified.
+func newWebhookDispatcher(store *tipStore,
+	endpoints []*webhookEndpoint) *webhookDispatcher {
+
+	ids := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		ids = append(ids, e.ID)
+	}
+	store.webhookEndpoints = ids
+
+	return &webhookDispatcher{
+		store:     store,
+		endpoints: endpoints,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+
+			// Redirects would turn the deliveries into GET
+			// requests, so they're reported as failures instead.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Start launches a goroutine delivering the notifications of each endpoint.
+func (d *webhookDispatcher) Start(ctx context.Context) {
+	ctx, d.cancel = context.WithCancel(ctx)
+
+	for _, e := range d.endpoints {
+		d.wg.Add(1)
+		go d.run(ctx, e)
+	}
+}
+
+// Stop signals the goroutines to exit and waits for them to do so.
+func (d *webhookDispatcher) Stop() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.wg.Wait()
+}
+
+// wake signals the goroutines that deliveries were queued. It's a no-op on a
+// nil dispatcher, so callers don't need to check whether webhooks are
+// configured.
+func (d *webhookDispatcher) wake() {
+	if d == nil {
+		return
+	}
+
+	for _, e := range d.endpoints {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run delivers the notifications of the endpoint as they become due.
+//
+// NOTE: This MUST be run as a goroutine.
+func (d *webhookDispatcher) run(ctx context.Context, e *webhookEndpoint) {
+	defer d.wg.Done()
+
+	for {
+		// Completed deliveries are pruned before looking for the next
+		// one, so the log doesn't grow without bounds.
+		err := d.store.pruneDeliveries(
+			e.ID, time.Now().Add(-webhookRetention),
+		)
+		if err != nil {
+			hookLog.Errorf("Unable to prune deliveries of %s: %v",
+				e.ID, err)
+		}
+
+		var wait <-chan time.Time
+		delivery, err := d.store.nextDelivery(e.ID)
+		switch {
+		case err != nil:
+			hookLog.Errorf("Unable to fetch next delivery of %s: %v",
+				e.ID, err)
+			wait = time.After(webhookMinBackoff)
+
+		case delivery == nil:
+			// Nothing to deliver until woken up.
+
+		case time.Until(delivery.NextAttempt) > 0:
+			wait = time.After(time.Until(delivery.NextAttempt))
+
+		default:
+			err := d.deliver(ctx, e, delivery)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				continue
+			}
+
+			// Retrying right away would flood the endpoint should
+			// the outcome never get recorded.
+			hookLog.Errorf("Unable to record delivery %d to %s: %v",
+				delivery.ID, e.ID, err)
+			wait = time.After(webhookMinBackoff)
+		}
+
+		select {
+		case <-wait:
+		case <-e.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver makes an attempt to deliver the notification to the endpoint,
+// recording its outcome.
+func (d *webhookDispatcher) deliver(ctx context.Context, e *webhookEndpoint,
+	delivery *webhookDelivery) error {
+
+	req, err := http.NewRequest(
+		http.MethodPost, e.URL, bytes.NewReader(delivery.Payload),
+	)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dcrtippin-webhook")
+	req.Header.Set(webhookEventHeader, webhookEventSettled)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(delivery.ID, 10))
+	req.Header.Set(
+		webhookSignatureHeader,
+		signWebhook(e.Secret, now.Unix(), delivery.Payload),
+	)
+
+	resp, err := d.client.Do(req)
+	if ctx.Err() != nil {
+		// The faucet is stopping, the attempt is made again on
+		// restart.
+		return nil
+	}
+
+	delivery.Attempts++
+	delivery.LastError = ""
+	if err != nil {
+		delivery.LastStatus = 0
+		delivery.LastError = err.Error()
+	} else {
+		io.Copy(ioutil.Discard, io.LimitReader(
+			resp.Body, webhookMaxResponseSize,
+		))
+		resp.Body.Close()
+
+		delivery.LastStatus = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			delivery.LastError = resp.Status
+		}
+	}
+
+	switch {
+	case delivery.LastError == "":
+		delivery.State = webhookDeliveryDelivered
+		delivery.CompletedAt = time.Now()
+		webhookDeliveries.inc(e.ID, string(delivery.State))
+		hookLog.Debugf("Delivered %d to %s", delivery.ID, e.ID)
+
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.State = webhookDeliveryFailed
+		delivery.CompletedAt = time.Now()
+		webhookDeliveries.inc(e.ID, string(delivery.State))
+		hookLog.Errorf("Giving up delivery %d to %s after %d attempts: "+
+			"%s", delivery.ID, e.ID, delivery.Attempts,
+			delivery.LastError)
+
+	default:
+		backoff := webhookBackoff(delivery.Attempts)
+		delivery.NextAttempt = time.Now().Add(backoff)
+		webhookDeliveries.inc(e.ID, "retry")
+		hookLog.Warnf("Delivery %d to %s failed, retrying in %v: %s",
+			delivery.ID, e.ID, backoff, delivery.LastError)
+	}
+
+	return d.store.updateDelivery(delivery)
+}
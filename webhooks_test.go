@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a delivery received by the test endpoint.
+type webhookRequest struct {
+	header     http.Header
+	body       []byte
+	receivedAt time.Time
+}
+
+// webhookTestEndpoint answers the deliveries it receives with the queued
+// status codes, then with 200 once none is left, and passes them on to the
+// test.
+type webhookTestEndpoint struct {
+	mtx      sync.Mutex
+	statuses []int
+
+	requests chan *webhookRequest
+}
+
+func (e *webhookTestEndpoint) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	e.mtx.Lock()
+	status := http.StatusOK
+	if len(e.statuses) > 0 {
+		status, e.statuses = e.statuses[0], e.statuses[1:]
+	}
+	e.mtx.Unlock()
+
+	w.WriteHeader(status)
+	e.requests <- &webhookRequest{
+		header:     r.Header,
+		body:       body,
+		receivedAt: time.Now(),
+	}
+}
+
+// receive returns the next delivery received by the endpoint.
+func (e *webhookTestEndpoint) receive(t *testing.T) *webhookRequest {
+	t.Helper()
+
+	select {
+	case req := <-e.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no delivery received")
+		return nil
+	}
+}
+
+// waitDelivery waits for the outcome of the given attempt of the only
+// delivery of the endpoint to be recorded, and returns the delivery.
+func waitDelivery(t *testing.T, store *tipStore, attempts int) *webhookDelivery {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, err := store.recentDeliveries(1)
+		if err != nil {
+			t.Fatalf("unable to fetch deliveries: %v", err)
+		}
+		if len(deliveries) == 1 && deliveries[0].Attempts == attempts {
+			return deliveries[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("attempt %d not recorded", attempts)
+	return nil
+}
+
+// checkSignature checks the signature of the delivery was made with secret
+// over the time it was sent and its body.
+func checkSignature(t *testing.T, req *webhookRequest, secret string) {
+	t.Helper()
+
+	signature := req.header.Get(webhookSignatureHeader)
+	matches := regexp.MustCompile(`^t=(\d+),v1=([0-9a-f]{64})$`).
+		FindStringSubmatch(signature)
+	if matches == nil {
+		t.Fatalf("malformed signature %q", signature)
+	}
+
+	timestamp, _ := strconv.ParseInt(matches[1], 10, 64)
+	sentAt := time.Unix(timestamp, 0)
+	if d := req.receivedAt.Sub(sentAt); d < -time.Second || d > 5*time.Second {
+		t.Fatalf("signed at %v, received at %v", sentAt, req.receivedAt)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", timestamp, req.body)
+	sig, _ := hex.DecodeString(matches[2])
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		t.Fatalf("invalid signature %q", signature)
+	}
+}
+
+// checkBackoff checks the next attempt of the delivery is scheduled the
+// backoff of its attempts after the last one was received.
+func checkBackoff(t *testing.T, d *webhookDelivery, req *webhookRequest) {
+	t.Helper()
+
+	backoff := webhookBackoff(d.Attempts)
+	wait := d.NextAttempt.Sub(req.receivedAt)
+	if wait < backoff || wait > backoff+time.Second {
+		t.Fatalf("attempt %d retried in %v, want %v", d.Attempts, wait,
+			backoff)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{webhookMaxAttempts, time.Hour},
+	}
+
+	for _, test := range tests {
+		backoff := webhookBackoff(test.attempts)
+		if backoff != test.backoff {
+			t.Errorf("backoff after %d attempts: got %v, want %v",
+				test.attempts, backoff, test.backoff)
+		}
+	}
+}
+
+// TestWebhookDelivery checks a delivery is signed, retried with the backoff
+// after the endpoint fails, and resumed from the database after the
+// dispatcher restarts.
+func TestWebhookDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcrtippin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := openTipStore(filepath.Join(dir, tipStoreFilename))
+	if err != nil {
+		t.Fatalf("unable to open tip store: %v", err)
+	}
+	defer store.Close()
+
+	handler := &webhookTestEndpoint{
+		statuses: []int{
+			http.StatusInternalServerError,
+			http.StatusServiceUnavailable,
+		},
+		requests: make(chan *webhookRequest, 1),
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	const secret = "0123456789abcdef"
+	endpoints := []*webhookEndpoint{{
+		ID:     "test",
+		URL:    server.URL,
+		Secret: secret,
+		wake:   make(chan struct{}, 1),
+	}}
+	dispatcher := newWebhookDispatcher(store, endpoints)
+	dispatcher.Start(context.Background())
+
+	// Settling a tip queues its delivery.
+	rHash := sha256.Sum256([]byte("tip"))
+	err = store.putTip(&tipRecord{
+		RHash:       rHash[:],
+		AmountAtoms: 1000,
+		State:       tipStateOpen,
+		CreatedAt:   time.Now(),
+		Expiry:      time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unable to store tip: %v", err)
+	}
+	err = store.updateTip(rHash[:], func(tip *tipRecord) {
+		tip.State = tipStateSettled
+		tip.AmtPaidAtoms = 1000
+	})
+	if err != nil {
+		t.Fatalf("unable to settle tip: %v", err)
+	}
+	dispatcher.wake()
+
+	first := handler.receive(t)
+	checkSignature(t, first, secret)
+	if event := first.header.Get(webhookEventHeader); event != webhookEventSettled {
+		t.Fatalf("event %q", event)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(first.body, &payload); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if payload.PaymentHash != hex.EncodeToString(rHash[:]) ||
+		payload.AmountAtoms != 1000 {
+
+		t.Fatalf("payload %+v", payload)
+	}
+	if id := first.header.Get(webhookDeliveryHeader); id != strconv.FormatUint(payload.ID, 10) {
+		t.Fatalf("delivery %q of payload %d", id, payload.ID)
+	}
+
+	d := waitDelivery(t, store, 1)
+	if d.State != webhookDeliveryPending ||
+		d.LastStatus != http.StatusInternalServerError {
+
+		t.Fatalf("after first attempt: %+v", d)
+	}
+	checkBackoff(t, d, first)
+
+	// The delivery is resumed by a new dispatcher once it's due, without
+	// being woken up.
+	dispatcher.Stop()
+	d.NextAttempt = time.Now()
+	if err := store.updateDelivery(d); err != nil {
+		t.Fatalf("unable to update delivery: %v", err)
+	}
+	dispatcher = newWebhookDispatcher(store, endpoints)
+	dispatcher.Start(context.Background())
+	defer dispatcher.Stop()
+
+	second := handler.receive(t)
+	checkSignature(t, second, secret)
+	if !bytes.Equal(second.body, first.body) {
+		t.Fatalf("resent %s, first sent %s", second.body, first.body)
+	}
+
+	d = waitDelivery(t, store, 2)
+	if d.State != webhookDeliveryPending ||
+		d.LastStatus != http.StatusServiceUnavailable {
+
+		t.Fatalf("after second attempt: %+v", d)
+	}
+	checkBackoff(t, d, second)
+
+	d.NextAttempt = time.Now()
+	if err := store.updateDelivery(d); err != nil {
+		t.Fatalf("unable to update delivery: %v", err)
+	}
+	dispatcher.wake()
+
+	third := handler.receive(t)
+	checkSignature(t, third, secret)
+	if !bytes.Equal(third.body, first.body) {
+		t.Fatalf("resent %s, first sent %s", third.body, first.body)
+	}
+
+	d = waitDelivery(t, store, 3)
+	if d.State != webhookDeliveryDelivered || d.LastError != "" {
+		t.Fatalf("after third attempt: %+v", d)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/decred/dcrd/dcrutil"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultWidgetLabel is the label of widgets that don't specify one.
+	defaultWidgetLabel = "Tip me"
+
+	// defaultWidgetTheme is the theme of widgets that don't specify one.
+	defaultWidgetTheme = "light"
+)
+
+var (
+	// widgetIDPattern matches the valid widget identifiers.
+	widgetIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+	// widgetThemes are the themes a widget may use.
+	widgetThemes = map[string]struct{}{
+		"light": {},
+		"dark":  {},
+	}
+)
+
+// widget is an embeddable tip button configured for a particular site.
+type widget struct {
+	// ID identifies the widget in the embed URLs.
+	ID string `json:"id"`
+
+	// Label is the text displayed on the widget.
+	Label string `json:"label"`
+
+	// Theme selects the look of the widget, either "light" or "dark".
+	Theme string `json:"theme"`
+
+	// Amounts are the preset tip amounts in DCR offered by the widget.
+	Amounts []string `json:"amounts"`
+
+	// AllowedOrigins are the origins, such as https://example.com, of the
+	// sites allowed to embed the widget. A single "*" allows any site.
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// validate checks the widget configuration, filling in defaults for the
+// optional fields. The preset amounts must be within minAmount and maxAmount.
+func (w *widget) validate(minAmount, maxAmount dcrutil.Amount) error {
+	if !widgetIDPattern.MatchString(w.ID) {
+		return fmt.Errorf("invalid widget id %q", w.ID)
+	}
+
+	if w.Label == "" {
+		w.Label = defaultWidgetLabel
+	}
+
+	if w.Theme == "" {
+		w.Theme = defaultWidgetTheme
+	}
+	if _, ok := widgetThemes[w.Theme]; !ok {
+		return fmt.Errorf("widget %s: unknown theme %q", w.ID, w.Theme)
+	}
+
+	for _, amt := range w.Amounts {
+		atoms, err := parseAmount(amt, defaultAmountUnit)
+		if err != nil || atoms < minAmount || atoms > maxAmount {
+			return fmt.Errorf("widget %s: invalid amount %q", w.ID,
+				amt)
+		}
+	}
+
+	for i, origin := range w.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" || strings.Trim(u.Path, "/") != "" {
+
+			return fmt.Errorf("widget %s: invalid origin %q, "+
+				"expected scheme://host[:port]", w.ID, origin)
+		}
+		w.AllowedOrigins[i] = u.Scheme + "://" + u.Host
+	}
+
+	return nil
+}
+
+// setFrameHeaders sets the headers which allow the widget to be embedded by
+// its allowed origins only.
+func (w *widget) setFrameHeaders(h http.Header) {
+	ancestors := []string{"'self'"}
+	for _, origin := range w.AllowedOrigins {
+		if origin == "*" {
+			ancestors = []string{"*"}
+			break
+		}
+		ancestors = append(ancestors, origin)
+	}
+	h.Set("Content-Security-Policy",
+		"frame-ancestors "+strings.Join(ancestors, " "))
+
+	// X-Frame-Options predates frame-ancestors and is only able to express
+	// a single origin. Browsers that understand CSP ignore it.
+	switch {
+	case ancestors[0] == "*":
+	case len(ancestors) == 1:
+		h.Set("X-Frame-Options", "SAMEORIGIN")
+	case len(ancestors) == 2:
+		h.Set("X-Frame-Options", "ALLOW-FROM "+ancestors[1])
+	}
+}
+
+// loadWidgets reads the widget configuration from the JSON file at path. An
+// empty path means no widgets are configured. The preset amounts of the
+// widgets must be within minAmount and maxAmount.
+func loadWidgets(path string, minAmount,
+	maxAmount dcrutil.Amount) (map[string]*widget, error) {
+
+	widgets := make(map[string]*widget)
+	if path == "" {
+		return widgets, nil
+	}
+
+	widgetsBytes, err := ioutil.ReadFile(cleanAndExpandPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var widgetList []*widget
+	if err := json.Unmarshal(widgetsBytes, &widgetList); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	for _, w := range widgetList {
+		if err := w.validate(minAmount, maxAmount); err != nil {
+			return nil, err
+		}
+		if _, ok := widgets[w.ID]; ok {
+			return nil, fmt.Errorf("duplicate widget id %q", w.ID)
+		}
+		widgets[w.ID] = w
+	}
+
+	return widgets, nil
+}
+
+// embedPath returns the path of the embedded page of the widget.
+func (w *widget) embedPath() string {
+	return "/embed/" + w.ID
+}
+
+// lookupWidget returns the widget identified in the URL, writing a not found
+// error to the response if there's no such widget.
+func (l *lightningFaucet) lookupWidget(w http.ResponseWriter,
+	r *http.Request) (*widget, bool) {
+
+	wgt, ok := l.widgets[mux.Vars(r)["widgetID"]]
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	return wgt, true
+}
+
+// renderEmbed renders the embeddable page of a widget, handling submissions
+// of its tip form.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) renderEmbed(w http.ResponseWriter, r *http.Request) {
+	wgt, ok := l.lookupWidget(w, r)
+	if !ok {
+		return
+	}
+	wgt.setFrameHeaders(w.Header())
+
+	embedTemplate := l.templates.Lookup("embed.html")
+	homeState := l.newHomePageContext()
+	homeState.Widget = wgt
+
+	switch r.Method {
+	case http.MethodGet:
+		if err := embedTemplate.Execute(w, homeState); err != nil {
+			log.Errorf("unable to render embed page: %v", err)
+		}
+
+	case http.MethodPost:
+		if r.URL.Query().Get("action") != GenerateInvoiceAction {
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+
+		l.generateInvoice(
+			embedTemplate, homeState, wgt.embedPath()+"/invoice/",
+			w, r,
+		)
+
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// embedInvoicePage renders the invoice identified in the URL within the
+// embeddable page of a widget.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) embedInvoicePage(w http.ResponseWriter,
+	r *http.Request) {
+
+	wgt, ok := l.lookupWidget(w, r)
+	if !ok {
+		return
+	}
+	wgt.setFrameHeaders(w.Header())
+
+	homeState, ok := l.invoicePageContext(w, r)
+	if !ok {
+		return
+	}
+	homeState.Widget = wgt
+
+	embedTemplate := l.templates.Lookup("embed.html")
+	if err := embedTemplate.Execute(w, homeState); err != nil {
+		log.Errorf("unable to render embed page: %v", err)
+	}
+}
+
+// widgetScript serves a script which inserts the widget as an iframe right
+// after the script tag that loaded it, so sites can embed the widget with a
+// single line of HTML.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) widgetScript(w http.ResponseWriter, r *http.Request) {
+	wgt, ok := l.lookupWidget(w, r)
+	if !ok {
+		return
+	}
+
+	// JSON encoding produces valid JavaScript string literals, escaping
+	// any characters that could end the script early.
+	src, _ := json.Marshal(l.publicURL + wgt.embedPath())
+	title, _ := json.Marshal(wgt.Label)
+
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	fmt.Fprintf(w, `(function() {
+  var script = document.currentScript;
+  var frame = document.createElement("iframe");
+  frame.src = %s;
+  frame.title = %s;
+  frame.width = "320";
+  frame.height = "420";
+  frame.style.border = "0";
+  script.parentNode.insertBefore(frame, script.nextSibling);
+})();
+`, src, title)
+}
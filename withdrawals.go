@@ -0,0 +1,665 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil"
+	"github.com/decred/dcrlnd/lnrpc"
+)
+
+const (
+	// withdrawalTimeout is how long to wait for the payment of a
+	// withdrawal to complete.
+	withdrawalTimeout = time.Minute
+
+	// withdrawalReconcileInterval is how often the withdrawals left
+	// pending are reconciled with the payments of dcrlnd.
+	withdrawalReconcileInterval = 10 * time.Minute
+
+	// withdrawalReleaseDelay is how long after it was started a pending
+	// withdrawal dcrlnd doesn't list as paid is released. The HTLCs of a
+	// payment time out within 2016 blocks, a week on mainnet, so by then
+	// it can't succeed anymore.
+	withdrawalReleaseDelay = 8 * 24 * time.Hour
+
+	// lightningURIPrefix is the scheme payment requests may be prefixed
+	// with.
+	lightningURIPrefix = "lightning:"
+)
+
+// withdrawalFeeLimit returns the largest fee in atoms that may be spent to pay
+// a withdrawal of the given amount, maxFee percent of it rounded up.
+func withdrawalFeeLimit(amt dcrutil.Amount, maxFee int64) int64 {
+	return (int64(amt)*maxFee + 99) / 100
+}
+
+// withdraw pays the given invoice of the recipient from their balance. The
+// amount of the invoice plus the fee limit is reserved from the balance while
+// the payment is in flight, and whatever isn't spent is returned once it
+// completes. Submitting an invoice that was already paid, or is being paid,
+// returns the existing withdrawal instead of paying it again.
+func (l *lightningFaucet) withdraw(rcpt *recipient,
+	payReqString string) (*withdrawalRecord, chanCreationError) {
+
+	payReqString = strings.TrimSpace(payReqString)
+	if strings.HasPrefix(strings.ToLower(payReqString), lightningURIPrefix) {
+		payReqString = payReqString[len(lightningURIPrefix):]
+	}
+	if payReqString == "" {
+		return nil, InvalidPaymentRequest
+	}
+
+	payReq, err := l.lnd.DecodePayReq(l.ctx, &lnrpc.PayReqString{
+		PayReq: payReqString,
+	})
+	if err != nil {
+		log.Debugf("Unable to decode payment request of %s: %v",
+			rcpt.Slug, err)
+		if isNodeUnavailable(err) {
+			return nil, NodeUnavailable
+		}
+		return nil, InvalidPaymentRequest
+	}
+
+	paymentHash, err := hex.DecodeString(payReq.PaymentHash)
+	if err != nil || len(paymentHash) != sha256.Size {
+		return nil, InvalidPaymentRequest
+	}
+
+	// The node can't pay itself.
+	info := l.nodeInfo.snapshot()
+	if info != nil && payReq.Destination == info.Pubkey {
+		return nil, InvalidPaymentRequest
+	}
+
+	if payReq.NumAtoms <= 0 {
+		return nil, PaymentRequestNoAmount
+	}
+
+	expiry := time.Duration(payReq.Expiry) * time.Second
+	if expiry == 0 {
+		expiry = defaultInvoiceExpiry
+	}
+	now := time.Now()
+	if now.After(time.Unix(payReq.Timestamp, 0).Add(expiry)) {
+		return nil, PaymentRequestExpired
+	}
+
+	amt := dcrutil.Amount(payReq.NumAtoms)
+	if amt < l.minWithdrawal {
+		return nil, WithdrawalAmountTooLow
+	}
+	if amt > l.maxWithdrawal {
+		return nil, WithdrawalAmountTooHigh
+	}
+
+	w := &withdrawalRecord{
+		PaymentHash:    paymentHash,
+		Recipient:      rcpt.Slug,
+		PaymentRequest: payReqString,
+		AmountAtoms:    int64(amt),
+		FeeLimitAtoms:  withdrawalFeeLimit(amt, l.withdrawalMaxFee),
+		State:          withdrawalStatePending,
+		CreatedAt:      time.Unix(now.Unix(), 0),
+	}
+	existing, err := l.store.beginWithdrawal(w)
+	switch {
+	case err == errInsufficientBalance:
+		return nil, InsufficientBalance
+	case err != nil:
+		log.Errorf("Unable to record withdrawal %x of %s: %v",
+			paymentHash, rcpt.Slug, err)
+		return nil, WithdrawalFailed
+	case existing != nil:
+		log.Debugf("Withdrawal %x of %s is already %s", paymentHash,
+			rcpt.Slug, existing.State)
+		return existing, NoError
+	}
+
+	log.Infof("Withdrawing %v for %s rhash=%x", amt, rcpt.Slug,
+		paymentHash)
+
+	return l.payWithdrawal(w), NoError
+}
+
+// payWithdrawal pays the invoice of a pending withdrawal and records the
+// outcome. When the outcome can't be determined, such as when the request to
+// dcrlnd times out, the withdrawal stays pending with its amount reserved so
+// it's neither paid twice nor credited back while it may have succeeded.
+func (l *lightningFaucet) payWithdrawal(w *withdrawalRecord) *withdrawalRecord {
+	ctx, cancel := context.WithTimeout(l.ctx, withdrawalTimeout)
+	defer cancel()
+
+	resp, err := l.lnd.SendPaymentSync(ctx, &lnrpc.SendRequest{
+		PaymentRequest: w.PaymentRequest,
+		FeeLimit: &lnrpc.FeeLimit{
+			Limit: &lnrpc.FeeLimit_Fixed{Fixed: w.FeeLimitAtoms},
+		},
+	})
+
+	var update func(*withdrawalRecord)
+	switch {
+	// The circuit breaker rejected the request, so it never reached the
+	// node.
+	case err == errNodeUnavailable:
+		update = func(w *withdrawalRecord) {
+			w.State = withdrawalStateFailed
+			w.Error = errNodeUnavailable.Error()
+		}
+
+	case err != nil:
+		log.Errorf("Outcome of withdrawal %x of %s unknown: %v",
+			w.PaymentHash, w.Recipient, err)
+
+		w.Error = err.Error()
+		err := l.store.updateWithdrawal(w.PaymentHash,
+			func(stored *withdrawalRecord) {
+				stored.Error = w.Error
+			})
+		if err != nil {
+			log.Errorf("Unable to record withdrawal %x: %v",
+				w.PaymentHash, err)
+		}
+		return w
+
+	case resp.PaymentError != "":
+		update = func(w *withdrawalRecord) {
+			w.State = withdrawalStateFailed
+			w.Error = resp.PaymentError
+		}
+
+	default:
+		update = func(w *withdrawalRecord) {
+			w.State = withdrawalStateSucceeded
+			w.PaymentPreimage = resp.PaymentPreimage
+			if resp.PaymentRoute != nil {
+				w.FeeAtoms = resp.PaymentRoute.TotalFees
+			}
+		}
+	}
+
+	finished, err := l.store.finishWithdrawal(w.PaymentHash,
+		func(w *withdrawalRecord) {
+			update(w)
+			w.CompletedAt = time.Now()
+		})
+	if err != nil {
+		log.Errorf("Unable to record outcome of withdrawal %x: %v",
+			w.PaymentHash, err)
+		update(w)
+		return w
+	}
+	logWithdrawalOutcome(finished)
+
+	return finished
+}
+
+// logWithdrawalOutcome logs the outcome of a finished withdrawal.
+func logWithdrawalOutcome(w *withdrawalRecord) {
+	if w.State == withdrawalStateSucceeded {
+		log.Infof("Withdrawal %x of %s paid %v with %v fees",
+			w.PaymentHash, w.Recipient, dcrutil.Amount(w.AmountAtoms),
+			dcrutil.Amount(w.FeeAtoms))
+	} else {
+		log.Warnf("Withdrawal %x of %s failed: %v", w.PaymentHash,
+			w.Recipient, w.Error)
+	}
+}
+
+// withdrawalReconciler records the outcome of the withdrawals left pending,
+// such as when dcrlnd timed out or the faucet was stopped while paying them,
+// so their amount isn't reserved forever. Withdrawals dcrlnd lists as paid
+// succeeded, and those it still doesn't list once their payment can't
+// succeed anymore are released, returning their amount to the balance of the
+// recipient.
+type withdrawalReconciler struct {
+	lnd   lnrpc.LightningClient
+	store *tipStore
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newWithdrawalReconciler creates a reconciler of the pending withdrawals
+// recorded in store.
+func newWithdrawalReconciler(lnd lnrpc.LightningClient,
+	store *tipStore) *withdrawalReconciler {
+
+	return &withdrawalReconciler{
+		lnd:   lnd,
+		store: store,
+	}
+}
+
+// Start launches the goroutine which reconciles the pending withdrawals,
+// right away and then every withdrawalReconcileInterval, until ctx is
+// canceled or the reconciler is stopped.
+func (r *withdrawalReconciler) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+
+	r.wg.Add(1)
+	go r.run(ctx)
+}
+
+// Stop terminates the reconciler and waits for it to exit.
+func (r *withdrawalReconciler) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// run reconciles the pending withdrawals every withdrawalReconcileInterval
+// until ctx is canceled.
+//
+// NOTE: This MUST be run as a goroutine.
+func (r *withdrawalReconciler) run(ctx context.Context) {
+	defer r.wg.Done()
+
+	r.reconcile(ctx, time.Now())
+
+	ticker := time.NewTicker(withdrawalReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.reconcile(ctx, time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcile records the outcome of the pending withdrawals that is known as
+// of now.
+func (r *withdrawalReconciler) reconcile(ctx context.Context, now time.Time) {
+	pending, err := r.store.pendingWithdrawals()
+	if err != nil {
+		log.Errorf("Unable to list pending withdrawals: %v", err)
+		return
+	}
+
+	// The withdrawals still being paid are left for payWithdrawal to
+	// record.
+	var stale []*withdrawalRecord
+	for _, w := range pending {
+		if now.Sub(w.CreatedAt) > withdrawalTimeout {
+			stale = append(stale, w)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	payments, err := listPayments(ctx, r.lnd)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warnf("Unable to list payments to reconcile %d "+
+				"pending withdrawals: %v", len(stale), err)
+		}
+		return
+	}
+
+	for _, w := range stale {
+		// The payments dcrlnd doesn't list may still complete until
+		// the release delay elapsed.
+		var reason string
+		if now.Sub(w.CreatedAt) > withdrawalReleaseDelay {
+			reason = "payment not completed by dcrlnd"
+		}
+
+		finished, err := resolveWithdrawal(
+			r.store, w, payments, reason, now,
+		)
+		switch {
+		// The outcome was recorded since the withdrawals were listed,
+		// by the operator or a submission of the same invoice.
+		case err == errWithdrawalNotPending:
+
+		case err != nil:
+			log.Errorf("Unable to record outcome of withdrawal "+
+				"%x: %v", w.PaymentHash, err)
+
+		case finished != nil:
+			log.Infof("Reconciled pending withdrawal %x of %s",
+				w.PaymentHash, w.Recipient)
+			logWithdrawalOutcome(finished)
+		}
+	}
+}
+
+// listPayments returns the payments completed by dcrlnd, keyed by their hex
+// encoded payment hash.
+func listPayments(ctx context.Context,
+	lnd lnrpc.LightningClient) (map[string]*lnrpc.Payment, error) {
+
+	resp, err := lnd.ListPayments(ctx, &lnrpc.ListPaymentsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	payments := make(map[string]*lnrpc.Payment, len(resp.Payments))
+	for _, payment := range resp.Payments {
+		payments[payment.PaymentHash] = payment
+	}
+
+	return payments, nil
+}
+
+// resolveWithdrawal records the outcome of the pending withdrawal w as of now,
+// given the payments completed by dcrlnd. The withdrawal succeeded if its
+// payment is listed, and otherwise failed for the given reason. It's left
+// pending, and nil returned, if its payment isn't listed and no reason is
+// given.
+func resolveWithdrawal(store *tipStore, w *withdrawalRecord,
+	payments map[string]*lnrpc.Payment, reason string,
+	now time.Time) (*withdrawalRecord, error) {
+
+	var update func(*withdrawalRecord)
+	payment, ok := payments[hex.EncodeToString(w.PaymentHash)]
+	switch {
+	case ok:
+		preimage, _ := hex.DecodeString(payment.PaymentPreimage)
+		update = func(w *withdrawalRecord) {
+			w.State = withdrawalStateSucceeded
+			w.PaymentPreimage = preimage
+			w.FeeAtoms = payment.Fee
+			w.Error = ""
+		}
+
+	case reason != "":
+		update = func(w *withdrawalRecord) {
+			w.State = withdrawalStateFailed
+			w.Error = reason
+		}
+
+	default:
+		return nil, nil
+	}
+
+	return store.finishWithdrawal(w.PaymentHash, func(w *withdrawalRecord) {
+		update(w)
+		w.CompletedAt = now
+	})
+}
+
+// lookupPayoutRecipient returns the recipient identified in the URL, writing
+// a not found error to the response if there's no such recipient or they
+// can't withdraw.
+func (l *lightningFaucet) lookupPayoutRecipient(w http.ResponseWriter,
+	r *http.Request) (*recipient, bool) {
+
+	rcpt, ok := l.lookupRecipient(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	if !l.withdrawalsEnabled || rcpt.PayoutTokenHash == "" {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	return rcpt, true
+}
+
+// authorizeWithdrawal checks the payout token given by a client, consuming a
+// rate limiting token so tokens can't be guessed.
+func (l *lightningFaucet) authorizeWithdrawal(w http.ResponseWriter,
+	r *http.Request, rcpt *recipient, token string) chanCreationError {
+
+	allowed, wait := l.withdrawLimiter.allow(r)
+	if !allowed {
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		return TooManyAttempts
+	}
+
+	if !rcpt.checkPayoutToken(token) {
+		log.Warnf("Invalid payout token for %s from %s", rcpt.Slug,
+			l.limiter.clientIP(r))
+		return InvalidPayoutToken
+	}
+
+	return NoError
+}
+
+// withdrawPageContext is the context used to render the withdrawal page of a
+// recipient.
+type withdrawPageContext struct {
+	*homePageContext
+
+	// Balance is the balance of the recipient in DCR, only displayed once
+	// they authenticated.
+	Balance string
+
+	// Withdrawal is the submitted withdrawal, if any.
+	Withdrawal *withdrawalRecord
+
+	// WithdrawalAmount and WithdrawalFee are the amount and fee of the
+	// submitted withdrawal in DCR.
+	WithdrawalAmount string
+	WithdrawalFee    string
+
+	// MaxFee is the largest fee of a withdrawal in percent of its amount.
+	MaxFee int64
+}
+
+// recipientWithdraw renders the withdrawal page of a recipient, handling the
+// submission of their invoices.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) recipientWithdraw(w http.ResponseWriter,
+	r *http.Request) {
+
+	rcpt, ok := l.lookupPayoutRecipient(w, r)
+	if !ok {
+		return
+	}
+
+	homeState := l.newHomePageContext()
+	l.setRecipient(homeState, rcpt)
+	homeState.PagePath = rcpt.pagePath() + "/withdraw"
+	homeState.MinAmount = formatAmount(l.minWithdrawal)
+	homeState.MaxAmount = formatAmount(l.maxWithdrawal)
+	pageState := &withdrawPageContext{
+		homePageContext: homeState,
+		MaxFee:          l.withdrawalMaxFee,
+	}
+
+	withdrawTemplate := l.templates.Lookup("withdraw.html")
+	render := func() {
+		err := withdrawTemplate.Execute(w, pageState)
+		if err != nil {
+			log.Errorf("unable to render withdrawal page: %v", err)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		render()
+		return
+
+	case http.MethodPost:
+
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "unable to parse form", http.StatusBadRequest)
+		return
+	}
+	payReq := r.FormValue("payreq")
+	homeState.FormFields["PayReq"] = payReq
+
+	submissionErr := l.authorizeWithdrawal(w, r, rcpt, r.FormValue("token"))
+	if submissionErr != NoError {
+		homeState.SubmissionError = submissionErr
+		w.WriteHeader(apiStatusCode(submissionErr))
+		render()
+		return
+	}
+
+	withdrawal, submissionErr := l.withdraw(rcpt, payReq)
+	homeState.SubmissionError = submissionErr
+	if withdrawal != nil {
+		pageState.Withdrawal = withdrawal
+		pageState.WithdrawalAmount = formatAmount(
+			dcrutil.Amount(withdrawal.AmountAtoms),
+		)
+		pageState.WithdrawalFee = formatAmount(
+			dcrutil.Amount(withdrawal.FeeAtoms),
+		)
+	}
+
+	balance, err := l.store.fetchBalance(rcpt.Slug)
+	if err != nil {
+		log.Errorf("Unable to fetch balance of %s: %v", rcpt.Slug, err)
+	} else {
+		pageState.Balance = formatAmount(dcrutil.Amount(balance))
+	}
+
+	render()
+}
+
+// withdrawalRequest is the body of a request to withdraw the balance of a
+// recipient.
+type withdrawalRequest struct {
+	// PaymentRequest is the invoice to pay, which determines the amount
+	// of the withdrawal.
+	PaymentRequest string `json:"payment_request"`
+}
+
+// withdrawalResponse is the JSON representation of a withdrawal.
+type withdrawalResponse struct {
+	PaymentHash     string          `json:"payment_hash"`
+	Recipient       string          `json:"recipient"`
+	Status          withdrawalState `json:"status"`
+	AmountAtoms     int64           `json:"amount_atoms"`
+	FeeAtoms        int64           `json:"fee_atoms"`
+	FeeLimitAtoms   int64           `json:"fee_limit_atoms"`
+	Error           string          `json:"error,omitempty"`
+	PaymentPreimage string          `json:"payment_preimage,omitempty"`
+	CreatedAt       int64           `json:"created_at"`
+	CompletedAt     int64           `json:"completed_at,omitempty"`
+}
+
+// newWithdrawalResponse returns the JSON representation of the withdrawal.
+func newWithdrawalResponse(w *withdrawalRecord) *withdrawalResponse {
+	resp := &withdrawalResponse{
+		PaymentHash:     hex.EncodeToString(w.PaymentHash),
+		Recipient:       w.Recipient,
+		Status:          w.State,
+		AmountAtoms:     w.AmountAtoms,
+		FeeAtoms:        w.FeeAtoms,
+		FeeLimitAtoms:   w.FeeLimitAtoms,
+		Error:           w.Error,
+		PaymentPreimage: hex.EncodeToString(w.PaymentPreimage),
+		CreatedAt:       w.CreatedAt.Unix(),
+	}
+	if !w.CompletedAt.IsZero() {
+		resp.CompletedAt = w.CompletedAt.Unix()
+	}
+
+	return resp
+}
+
+// balanceResponse is the JSON representation of the balance of a recipient.
+type balanceResponse struct {
+	Recipient    string `json:"recipient"`
+	BalanceAtoms int64  `json:"balance_atoms"`
+}
+
+// apiAuthorizeRecipient authenticates an API request on behalf of the
+// recipient identified in the URL with the payout token given as a bearer
+// token, writing an error to the response if it fails.
+func (l *lightningFaucet) apiAuthorizeRecipient(w http.ResponseWriter,
+	r *http.Request) (*recipient, bool) {
+
+	rcpt, ok := l.lookupPayoutRecipient(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	const bearerPrefix = "Bearer "
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, bearerPrefix) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized,
+			InvalidPayoutToken.Code(), InvalidPayoutToken.String())
+		return nil, false
+	}
+
+	submissionErr := l.authorizeWithdrawal(
+		w, r, rcpt, strings.TrimPrefix(token, bearerPrefix),
+	)
+	if submissionErr != NoError {
+		writeAPIError(w, apiStatusCode(submissionErr),
+			submissionErr.Code(), submissionErr.String())
+		return nil, false
+	}
+
+	return rcpt, true
+}
+
+// apiRecipientBalance returns the balance of the recipient identified in the
+// URL.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) apiRecipientBalance(w http.ResponseWriter,
+	r *http.Request) {
+
+	rcpt, ok := l.apiAuthorizeRecipient(w, r)
+	if !ok {
+		return
+	}
+
+	balance, err := l.store.fetchBalance(rcpt.Slug)
+	if err != nil {
+		log.Errorf("Unable to fetch balance of %s: %v", rcpt.Slug, err)
+		writeAPIError(w, http.StatusInternalServerError,
+			"balance_unavailable", "unable to fetch balance")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &balanceResponse{
+		Recipient:    rcpt.Slug,
+		BalanceAtoms: balance,
+	})
+}
+
+// apiWithdraw pays the invoice in the JSON withdrawalRequest from the balance
+// of the recipient identified in the URL. Once a withdrawal is started it's
+// returned whatever its outcome, clients must check its status.
+//
+// NOTE: This method implements the http.Handler interface.
+func (l *lightningFaucet) apiWithdraw(w http.ResponseWriter, r *http.Request) {
+	rcpt, ok := l.apiAuthorizeRecipient(w, r)
+	if !ok {
+		return
+	}
+
+	var req withdrawalRequest
+	body := http.MaxBytesReader(w, r.Body, maxAPIRequestSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request",
+			"request body must be a JSON object")
+		return
+	}
+
+	withdrawal, submissionErr := l.withdraw(rcpt, req.PaymentRequest)
+	if submissionErr != NoError {
+		writeAPIError(w, apiStatusCode(submissionErr),
+			submissionErr.Code(), submissionErr.String())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newWithdrawalResponse(withdrawal))
+}